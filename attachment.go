@@ -0,0 +1,108 @@
+package singlepage
+
+import (
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// DefaultAttachmentTypes are the attachment types that are inlined if
+// Options.AttachmentTypes is nil.
+var DefaultAttachmentTypes = []string{
+	"application/pdf", "application/json", "application/xml", "application/zip",
+	"text/plain", "text/csv", "text/tab-separated-values", "text/xml",
+	"application/vnd.ms-excel", "application/msword",
+	"application/vnd.openxmlformats-officedocument.*",
+	"application/vnd.oasis.opendocument.*",
+	"image/*", "audio/*", "video/*",
+}
+
+// Replace <a download href="..">, <object data="..">, and <embed src=".."> with
+// data: URIs.
+//
+// Only types in AttachmentTypes are inlined, so that <a download> for (for
+// example) HTML pages still work as links. The download attribute is set to
+// the filename if it's empty, as data: URIs don't have a filename.
+func replaceAttachments(doc *goquery.Document, opts Options) (err error) {
+	if !opts.Local.Has(Attachment) && !opts.Remote.Has(Attachment) {
+		return nil
+	}
+
+	base, err := opts.baseURL()
+	if err != nil {
+		return err
+	}
+
+	doc.Find(`a[download][href], object[data], embed[src]`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		attr := "src"
+		switch {
+		case s.Is("a"):
+			attr = "href"
+		case s.Is("object"):
+			attr = "data"
+		}
+		ref := s.AttrOr(attr, "")
+
+		var data string
+		data, err = inlineData(opts, base, ref, Attachment, opts.MaxAttachmentSize)
+		if err != nil {
+			return false
+		}
+		if data == "" {
+			return true
+		}
+		if s.Is("a") && strings.TrimSpace(s.AttrOr("download", "")) == "" {
+			if u, _ := resolve(base, ref); u != nil {
+				if name := path.Base(u.Path); name != "/" && name != "." {
+					s.SetAttr("download", name)
+				}
+			}
+		}
+		s.SetAttr(attr, data)
+		return true
+	})
+	return err
+}
+
+// Report if the attachment at p with the media type m is in AttachmentTypes.
+func (opts Options) isAttachmentType(p, m string) bool {
+	types := opts.AttachmentTypes
+	if types == nil {
+		types = DefaultAttachmentTypes
+	}
+
+	ext := strings.ToLower(path.Ext(stripQuery(p)))
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case t == "":
+		case t[0] == '.':
+			if t == ext {
+				return true
+			}
+		case strings.HasSuffix(t, "*"):
+			if strings.HasPrefix(m, t[:len(t)-1]) {
+				return true
+			}
+		case t == m:
+			return true
+		}
+	}
+	return false
+}
+
+// Guess the media type of p from its extension; this returns "" if the
+// extension is unknown.
+func guessType(p string) string {
+	ext := strings.ToLower(path.Ext(stripQuery(p)))
+	if ext == "" {
+		return ""
+	}
+	if m, ok := extTypes[ext]; ok {
+		return m
+	}
+	m, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	return m
+}
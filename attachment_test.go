@@ -0,0 +1,93 @@
+package singlepage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestReplaceAttachments(t *testing.T) {
+	csv := `data:text/csv;base64,YSxiCjEsMgo=`
+	pdf := `data:application/pdf;base64,JVBERi0xLjQ=`
+
+	tests := []struct {
+		in, want string
+		opts     Options
+	}{
+		{
+			`<a href="files/data.csv" download="">CSV</a><a href="files/data.csv" download="x.csv">CSV</a><a href="files/data.csv">CSV</a>`,
+			`<a href="` + csv + `" download="data.csv">CSV</a><a href="` + csv + `" download="x.csv">CSV</a><a href="files/data.csv">CSV</a>`,
+			Options{Local: Attachment},
+		},
+		{
+			`<object data="files/chart.pdf" type="application/pdf"></object><embed src="files/chart.pdf"/>`,
+			`<object data="` + pdf + `" type="application/pdf"></object><embed src="` + pdf + `"/>`,
+			Options{Local: Attachment},
+		},
+		{ // Sniff MIME type.
+			`<a href="files/notes" download="">x</a><a href="files/blob" download="">x</a>`,
+			`<a href="data:text/plain;base64,SnVzdCBzb21lIHRleHQ=" download="notes">x</a><a href="files/blob" download="">x</a>`,
+			Options{Local: Attachment},
+		},
+		{ // Filter
+			`<a href="files/page.html" download="">x</a><a href="files/data.csv" download="">x</a><object data="files/chart.pdf"></object>`,
+			`<a href="data:text/html;base64,PHA+SGVsbG88L3A+" download="page.html">x</a><a href="files/data.csv" download="">x</a>` +
+				`<object data="` + pdf + `"></object>`,
+			Options{Local: Attachment, AttachmentTypes: []string{".HTML", "application/*"}},
+		},
+		{ // Size limit.
+			`<a href="files/big.csv" download="">x</a><a href="files/data.csv" download="">x</a>`,
+			`<a href="files/big.csv" download="">x</a><a href="` + csv + `" download="data.csv">x</a>`,
+			Options{Local: Attachment, MaxAttachmentSize: 8, Quiet: true},
+		},
+		{ // Not enabled, not found.
+			`<object data="files/chart.pdf"></object><embed src="files/x.pdf"/>`,
+			`<object data="files/chart.pdf"></object><embed src="files/x.pdf"/>`,
+			Options{Local: Image, Remote: Attachment, Quiet: true},
+		},
+		{ // SVG attachments are kept as-is.
+			`<a href="files/img.svg" download="">x</a>`,
+			`<a href="data:image/svg+xml;base64,PHN2Zz48aW1hZ2UgaHJlZj0icC5wbmciLz48L3N2Zz4=" download="img.svg">x</a>`,
+			Options{Local: Attachment | Image, Minify: Image},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.in = `<html><head></head><body>` + tt.in + `</body></html>`
+			tt.want = `<html><head></head><body>` + tt.want + `</body></html>`
+			tt.opts.Root = "./testdata/attachment"
+
+			o, err := Bundle([]byte(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+
+	t.Run("filter before fetch", func(t *testing.T) {
+		var (
+			mu      sync.Mutex
+			fetched []string
+		)
+		f := FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+			mu.Lock()
+			fetched = append(fetched, path)
+			mu.Unlock()
+			return new(DefaultFetcher).Fetch(ctx, path)
+		})
+		_, err := Bundle([]byte(`<a href="files/page.html" download>x</a><a href="files/data.csv" download>x</a><a href="files/notes" download>x</a>`),
+			Options{Root: "./testdata/attachment", Local: Attachment, AttachmentTypes: []string{"application/*"}, Fetcher: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"testdata/attachment/files/notes"}; !slices.Equal(fetched, want) {
+			t.Errorf("\nfetched: %v\nwant:    %v", fetched, want)
+		}
+	})
+}
@@ -2,18 +2,26 @@ package singlepage
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"mime"
-	"path/filepath"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/tdewolff/minify/v2"
 	"github.com/tdewolff/minify/v2/css"
 	"github.com/tdewolff/minify/v2/html"
 	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/svg"
 	"zgo.at/zstd/zint"
 )
 
@@ -24,16 +32,136 @@ const (
 	JS
 	Image
 	Font
+	Media
+	Frame
+	Attachment
+)
+
+// BaseMode controls what to do with the document's <base> element.
+type BaseMode uint8
+
+// BaseMode values.
+const (
+	// Leave the <base> element as-is.
+	BaseKeep BaseMode = iota
+
+	// Remove the <base> element. The target attribute is retained, if any.
+	BaseRemove
+
+	// Rewrite a remote <base> to an absolute URL, so that any references
+	// that weren't bundled (such as links) still work. Local bases are left
+	// alone.
+	BaseRewrite
+)
+
+// DeferMode controls how the execution order of inlined "defer" and "async"
+// scripts is emulated.
+//
+// Inlined scripts always run as soon as they're parsed, whereas scripts with
+// "defer" run after the document is parsed, and "async" scripts whenever
+// they're loaded. This only applies to classic scripts: module scripts are
+// always deferred, even when inlined.
+type DeferMode uint8
+
+// DeferMode values.
+const (
+	// Leave scripts where they are, running them immediately.
+	DeferKeep DeferMode = iota
+
+	// Move deferred and async scripts to the end of the <body>, in the order
+	// they appear in the document. Scripts that can't be inlined are moved as
+	// well, without the defer and async attributes, so they still run in
+	// order.
+	DeferMove
+
+	// Wrap deferred and async scripts in a DOMContentLoaded event handler.
+	// Note this changes the scope of the script: top-level variables and
+	// functions are no longer global.
+	DeferEvent
 )
 
 // Options for Bundle().
 type Options struct {
+	// Root directory or URL to resolve references in the document against.
+	// This may be local (e.g. "./site/") or remote (e.g.
+	// "https://example.com/docs/"), and is always treated as a directory.
 	Root   string
 	Strict bool
 	Quiet  bool
 	Local  zint.Bitflag16
 	Remote zint.Bitflag16
 	Minify zint.Bitflag16
+
+	// Fetcher to retrieve resources with; uses DefaultFetcher if nil.
+	Fetcher Fetcher
+
+	// Additional attributes to remove from <script> elements when inlining
+	// them. The src and integrity attributes are always removed, and defer
+	// and async are removed unless Defer is DeferKeep. All other attributes
+	// are kept.
+	ScriptDropAttr []string
+
+	// Handlers for <script> types, keyed by the lower-case type without
+	// parameters (e.g. "text/x-handlebars"). A handler gets the script's
+	// contents and returns the new contents.
+	//
+	// These are used in addition to the built-in handling, which minifies
+	// JavaScript and JSON (if Minify has JS), and leaves all other types
+	// alone. Handlers set here take precedence.
+	ScriptHandlers map[string]func(script string) (string, error)
+
+	// How to emulate the execution order of deferred and async scripts.
+	Defer DeferMode
+
+	// What to do with the <base> element after bundling.
+	Base BaseMode
+
+	// How to inline srcset attributes on <img> and <picture><source>.
+	Srcset SrcsetMode
+
+	// Descriptor of the srcset candidate to keep with SrcsetMatch, such as
+	// "2x" or "800w".
+	SrcsetDescriptor string
+
+	// How to inline SVG images. SVGs are minified if Minify has Image.
+	SVG SVGMode
+
+	// Maximum number of resources to fetch concurrently. The default of 0
+	// uses 8; set to 1 to fetch everything serially.
+	Parallel int
+
+	// Maximum depth of nested CSS @imports; the default of 0 uses 16.
+	MaxImportDepth int
+
+	// Maximum depth of nested <iframe>s; the default of 0 uses 4.
+	MaxFrameDepth int
+
+	// Maximum size in bytes of media files (video, audio, and subtitles) to
+	// inline; larger files are left alone. The default of 0 means there is
+	// no limit.
+	MaxMediaSize int64
+
+	// Maximum size in bytes of attachments to inline; larger files are left
+	// alone. The default of 0 means there is no limit.
+	MaxAttachmentSize int64
+
+	// Types of attachments to inline, as extensions (".pdf") or media types
+	// ("text/csv"); media types may end with "*" to match a prefix (e.g.
+	// "image/*"). Uses DefaultAttachmentTypes if nil.
+	AttachmentTypes []string
+
+	// Maximum time to spend on bundling the entire document, including all
+	// fetches. The default of 0 means there is no limit (individual fetches
+	// may still time out).
+	Timeout time.Duration
+
+	// Set by Bundle().
+	ctx        context.Context
+	base       *url.URL    // Document base URL.
+	cache      *assetCache // Fetched and processed resources.
+	collect    *collector  // Only collect paths to fetch, rather than fetching.
+	svgChain   []string    // SVG images that are being inlined.
+	frameChain []string    // Documents in <iframe>s that are being bundled.
 }
 
 // Everything is an Options struct with everything enabled.
@@ -50,6 +178,8 @@ func init() {
 	minifier.AddFunc("css", css.Minify)
 	minifier.AddFunc("html", html.Minify)
 	minifier.AddFunc("js", js.Minify)
+	minifier.AddFunc("json", json.Minify)
+	minifier.AddFunc(svgType, svg.Minify)
 }
 
 // NewOptions creates a new Options instance.
@@ -72,6 +202,12 @@ func (opts *Options) Commandline(local, remote, minify []string) error {
 			opts.Local |= Image
 		case "font", "fonts":
 			opts.Local |= Font
+		case "media", "video", "audio":
+			opts.Local |= Media
+		case "frame", "frames", "iframe", "iframes":
+			opts.Local |= Frame
+		case "attachment", "attachments", "download", "downloads":
+			opts.Local |= Attachment
 		default:
 			return fmt.Errorf("unknown value for -local: %q", v)
 		}
@@ -88,6 +224,12 @@ func (opts *Options) Commandline(local, remote, minify []string) error {
 			opts.Remote |= Image
 		case "font", "fonts":
 			opts.Remote |= Font
+		case "media", "video", "audio":
+			opts.Remote |= Media
+		case "frame", "frames", "iframe", "iframes":
+			opts.Remote |= Frame
+		case "attachment", "attachments", "download", "downloads":
+			opts.Remote |= Attachment
 		default:
 			return fmt.Errorf("unknown value for -remote: %q", v)
 		}
@@ -102,6 +244,8 @@ func (opts *Options) Commandline(local, remote, minify []string) error {
 			opts.Minify |= JS
 		case "html":
 			opts.Minify |= HTML
+		case "img", "image", "images", "svg":
+			opts.Minify |= Image
 		default:
 			return fmt.Errorf("unknown value for -minify: %q", v)
 		}
@@ -111,30 +255,102 @@ func (opts *Options) Commandline(local, remote, minify []string) error {
 
 // Bundle the resources in a HTML document according to the given options.
 func Bundle(html []byte, opts Options) (string, error) {
-	if opts.Root != "./" {
-		opts.Root = strings.TrimRight(opts.Root, "/")
+	return NewBundler(opts).BundleContext(context.Background(), html)
+}
+
+// BundleContext bundles the resources in a HTML document according to the
+// given options.
+//
+// The context is passed to the Fetcher, and ctx.Err() is returned as soon as
+// it's cancelled.
+func BundleContext(ctx context.Context, html []byte, opts Options) (string, error) {
+	return NewBundler(opts).BundleContext(ctx, html)
+}
+
+// Bundler bundles HTML documents.
+//
+// Fetched and processed assets are shared between all documents bundled with
+// the same Bundler, so a stylesheet used in many documents is fetched and
+// minified only once. Warnings for assets are only reported the first time the
+// asset is processed.
+//
+// A Bundler is safe for concurrent use by multiple goroutines.
+type Bundler struct {
+	opts  Options
+	cache *assetCache
+}
+
+// NewBundler creates a new Bundler with the given options.
+func NewBundler(opts Options) *Bundler {
+	return &Bundler{opts: opts, cache: newAssetCache()}
+}
+
+// Bundle the resources in a HTML document.
+func (b *Bundler) Bundle(html []byte) (string, error) {
+	return b.BundleContext(context.Background(), html)
+}
+
+// BundleReader bundles the resources in the HTML document read from r.
+func (b *Bundler) BundleReader(r io.Reader) (string, error) {
+	return b.BundleReaderContext(context.Background(), r)
+}
+
+// BundleReaderContext bundles the resources in the HTML document read from r.
+//
+// The context is used like in BundleContext.
+func (b *Bundler) BundleReaderContext(ctx context.Context, r io.Reader) (string, error) {
+	html, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return b.BundleContext(ctx, html)
+}
+
+// BundleContext bundles the resources in a HTML document.
+//
+// The context is passed to the Fetcher, and ctx.Err() is returned as soon as
+// it's cancelled.
+func (b *Bundler) BundleContext(ctx context.Context, html []byte) (string, error) {
+	opts := b.opts
+	opts.cache = b.cache
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
 	}
+	opts.ctx = ctx
 
+	h, err := bundle(html, opts)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return "", ctxErr
+	}
+	return h, err
+}
+
+func bundle(html []byte, opts Options) (string, error) {
 	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(html))
 	if err != nil {
 		return "", err
 	}
 
-	if err := minifyStyleTags(doc, opts); err != nil {
-		return "", fmt.Errorf("minifyStyleTags: %w", err)
-	}
-	if err := replaceCSSLinks(doc, opts); err != nil {
-		return "", fmt.Errorf("replaceCSSLinks: %w", err)
+	opts.base, err = documentBase(doc, opts)
+	if err != nil {
+		return "", err
 	}
-	if err := replaceCSSImports(doc, opts); err != nil {
-		return "", fmt.Errorf("replaceCSSImports: %w", err)
+
+	// Frames are bundled while prefetching the parent document, so everything
+	// they reference is collected there.
+	if opts.parallel() > 1 && opts.collect == nil {
+		prefetch(doc, opts)
 	}
-	if err := replaceJS(doc, opts); err != nil {
-		return "", fmt.Errorf("replaceJS: %w", err)
+	if err := opts.context().Err(); err != nil {
+		return "", err
 	}
-	if err := replaceImg(doc, opts); err != nil {
-		return "", fmt.Errorf("replaceImg: %w", err)
+
+	if err := replace(doc, opts); err != nil {
+		return "", err
 	}
+	rewriteBase(doc, opts)
 
 	h, err := doc.Html()
 	if err != nil {
@@ -146,6 +362,98 @@ func Bundle(html []byte, opts Options) (string, error) {
 	return h, nil
 }
 
+// Replace all the resources in doc.
+func replace(doc *goquery.Document, opts Options) error {
+	steps := []struct {
+		name string
+		f    func(*goquery.Document, Options) error
+	}{
+		{"minifyStyleTags", minifyStyleTags},
+		{"replaceCSSLinks", replaceCSSLinks},
+		{"replaceCSSImports", replaceCSSImports},
+		{"replaceStyleAttrs", replaceStyleAttrs},
+		{"replaceJS", replaceJS},
+		{"replaceImg", replaceImg},
+		{"replaceSVGUse", replaceSVGUse},
+		{"replaceMedia", replaceMedia},
+		{"replaceFrames", replaceFrames},
+		{"replaceAttachments", replaceAttachments},
+	}
+	ctx := opts.context()
+	for _, s := range steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.f(doc, opts); err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+func (opts Options) context() context.Context {
+	if opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
+func (opts Options) parallel() int {
+	if opts.Parallel < 1 {
+		return 8
+	}
+	return opts.Parallel
+}
+
+// Fetch all resources in the document concurrently.
+//
+// This runs replace() on a copy of the document, collecting all paths instead
+// of fetching them. These are then fetched concurrently, and the process is
+// repeated until there is nothing left to fetch, since fetched stylesheets may
+// reference more resources.
+//
+// The actual replace() run will then use the cached results, so the output is
+// identical to fetching everything serially. Any errors are ignored here, and
+// reported by the actual run.
+func prefetch(doc *goquery.Document, opts Options) {
+	dry := opts
+	dry.Strict, dry.Quiet = false, true
+	dry.Minify = 0 // Never affects what gets fetched.
+	ctx := opts.context()
+	for {
+		dry.collect = &collector{}
+		_ = replace(goquery.CloneDocument(doc), dry)
+		if len(dry.collect.reqs) == 0 || ctx.Err() != nil {
+			return
+		}
+		opts.cache.fetchAll(ctx, opts.fetcher(), dry.collect.reqs, opts.parallel())
+	}
+}
+
+// Remove or rewrite <base href="..">.
+func rewriteBase(doc *goquery.Document, opts Options) {
+	if opts.Base == BaseKeep {
+		return
+	}
+
+	s := doc.Find(`base[href]`).First()
+	if s.Length() == 0 {
+		return
+	}
+	switch opts.Base {
+	case BaseRemove:
+		if _, ok := s.Attr("target"); ok {
+			s.RemoveAttr("href")
+		} else {
+			s.Remove()
+		}
+	case BaseRewrite:
+		if isRemoteURL(opts.base) {
+			s.SetAttr("href", opts.base.String())
+		}
+	}
+}
+
 func minifyStyleTags(doc *goquery.Document, opts Options) (err error) {
 	if !opts.Minify.Has(CSS) {
 		return nil
@@ -157,7 +465,7 @@ func minifyStyleTags(doc *goquery.Document, opts Options) (err error) {
 		if err != nil {
 			return false
 		}
-		s.SetHtml(f)
+		s.SetHtml(escapeStyle(f))
 		return true
 	})
 
@@ -169,33 +477,64 @@ func replaceJS(doc *goquery.Document, opts Options) (err error) {
 		return nil
 	}
 
-	var cont bool
+	base, err := opts.baseURL()
+	if err != nil {
+		return err
+	}
+
+	mods, err := newModules(doc, opts, base)
+	if err != nil {
+		return err
+	}
+
+	var (
+		cont     bool
+		deferred []*goquery.Selection
+	)
 	doc.Find(`script`).EachWithBreak(func(i int, s *goquery.Selection) bool {
-		path, ok := s.Attr("src")
+		ref, ok := s.Attr("src")
+		typ := scriptType(s)
 		if !ok {
-			if !opts.Minify.Has(JS) {
-				return true
+			f := s.Text()
+			if typ == "module" {
+				f, err = mods.rewrite(base, f)
+				if err != nil {
+					return false
+				}
 			}
-
-			var f string
-			f, err = minifier.String("js", s.Text())
+			f, err = processScript(opts, typ, f)
 			if err != nil {
 				return false
 			}
-			s.SetHtml(f)
+			s.SetHtml(escapeScript(typ, f))
 			return true
 		}
-		path = opts.Root + path
+		// Move all deferred scripts, including those that aren't inlined, to
+		// keep them in order.
+		isDeferred := isDeferred(s) && isJSType(typ)
+		if isDeferred && opts.Defer == DeferMove {
+			deferred = append(deferred, s)
+		}
 
-		if isRemote(path) && !opts.Remote.Has(JS) {
+		var u *url.URL
+		u, err = resolve(base, ref)
+		cont, err = warn(opts, err)
+		if err != nil {
+			return false
+		}
+		if !cont || u == nil {
 			return true
 		}
-		if !isRemote(path) && !opts.Local.Has(JS) {
+
+		if isRemoteURL(u) && !opts.Remote.Has(JS) {
+			return true
+		}
+		if !isRemoteURL(u) && !opts.Local.Has(JS) {
 			return true
 		}
 
-		var f []byte
-		f, err = readPath(path)
+		var res *Resource
+		res, err = opts.fetch(u)
 		cont, err = warn(opts, err)
 		if err != nil {
 			return false
@@ -204,29 +543,116 @@ func replaceJS(doc *goquery.Document, opts Options) (err error) {
 			return true
 		}
 
-		if opts.Minify.Has(JS) {
-			f, err = minifier.Bytes("js", f)
+		f := string(res.Data)
+		if typ == "module" {
+			f, err = mods.rewrite(resourceURL(u, res), f)
 			if err != nil {
 				return false
 			}
 		}
+		f, err = opts.process("js "+typ, res.URL, f, func() (string, error) {
+			return processScript(opts, typ, f)
+		})
+		if err != nil {
+			return false
+		}
+		if !isJSType(typ) && !isJSONType(typ) && reEndScript.MatchString(f) {
+			_, err = warn(opts, &ParseError{Path: res.URL, Err: fmt.Errorf(
+				"not inlining %s: contains </script, which can't be escaped for type %q", res.URL, typ)})
+			return err == nil
+		}
 
-		var attr []string
-		for _, a := range s.Nodes[0].Attr {
-			if strings.HasPrefix(a.Key, "data-") {
-				attr = append(attr, fmt.Sprintf(`%s="%s"`, a.Key, strings.ReplaceAll(a.Val, `"`, `&quot;`)))
-			}
+		drop := append(slices.Clip(opts.ScriptDropAttr), "src", "integrity")
+		if isDeferred && opts.Defer != DeferKeep {
+			// These don't do anything on inline scripts.
+			drop = append(drop, "defer", "async")
 		}
-		tag := "<script>"
-		if len(attr) > 0 {
-			tag = "<script " + strings.Join(attr, " ") + ">"
+		if isDeferred && opts.Defer == DeferEvent {
+			f = `document.addEventListener("DOMContentLoaded",function(){` + f + "\n})"
+		}
+
+		s.AfterHtml("<script" + formatAttr(s.Nodes[0].Attr, drop...) + ">" + escapeScript(typ, f) + "</script>")
+		if isDeferred && opts.Defer == DeferMove {
+			deferred[len(deferred)-1] = s.Next()
 		}
-		s.AfterHtml(tag + string(f) + "</script>")
 		s.Remove()
 		return true
 	})
+	if err != nil {
+		return err
+	}
+	if err := mods.writeImportMap(doc); err != nil {
+		return err
+	}
 
-	return err
+	if len(deferred) > 0 {
+		body := doc.Find("body")
+		for _, d := range deferred {
+			// Scripts that weren't inlined would otherwise run after all the
+			// inlined ones.
+			body.AppendSelection(d.RemoveAttr("defer").RemoveAttr("async"))
+		}
+	}
+	return nil
+}
+
+// Get the type of a <script> element, lower-cased and without parameters.
+// Scripts without a type attribute return "".
+func scriptType(s *goquery.Selection) string {
+	t, _, _ := strings.Cut(s.AttrOr("type", ""), ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// Process the contents of a <script> element based on its type.
+func processScript(opts Options, typ, script string) (string, error) {
+	if h, ok := opts.ScriptHandlers[typ]; ok {
+		return h(script)
+	}
+	if !opts.Minify.Has(JS) {
+		return script, nil
+	}
+
+	switch {
+	case isJSType(typ):
+		return minifier.String("js", script)
+	case isJSONType(typ):
+		return minifier.String("json", script)
+	default: // Templates and other data blocks.
+		return script, nil
+	}
+}
+
+// Report if the script type is a JavaScript type.
+//
+// https://html.spec.whatwg.org/multipage/scripting.html#javascript-mime-type
+func isJSType(typ string) bool {
+	switch typ {
+	case "", "module",
+		"text/javascript", "application/javascript", "application/ecmascript",
+		"application/x-ecmascript", "application/x-javascript", "text/ecmascript",
+		"text/javascript1.0", "text/javascript1.1", "text/javascript1.2",
+		"text/javascript1.3", "text/javascript1.4", "text/javascript1.5",
+		"text/jscript", "text/livescript", "text/x-ecmascript", "text/x-javascript":
+		return true
+	}
+	return false
+}
+
+// Report if the script type is a JSON type.
+func isJSONType(typ string) bool {
+	return typ == "importmap" || typ == "speculationrules" ||
+		typ == "application/json" || typ == "text/json" || strings.HasSuffix(typ, "+json")
+}
+
+// Report if a <script src=".."> runs deferred: it has a defer or async
+// attribute, and is not a module script (which are always deferred).
+func isDeferred(s *goquery.Selection) bool {
+	if strings.EqualFold(strings.TrimSpace(s.AttrOr("type", "")), "module") {
+		return false
+	}
+	_, d := s.Attr("defer")
+	_, a := s.Attr("async")
+	return d || a
 }
 
 func replaceImg(doc *goquery.Document, opts Options) (err error) {
@@ -234,54 +660,177 @@ func replaceImg(doc *goquery.Document, opts Options) (err error) {
 		return nil
 	}
 
-	var cont bool
-	doc.Find(`img, link[rel="icon"]`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+	base, err := opts.baseURL()
+	if err != nil {
+		return err
+	}
+
+	doc.Find(`img, link[rel="icon"], picture > source[srcset]`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if s.Is("source") {
+			if opts.Srcset == SrcsetSrc {
+				s.Remove()
+				return true
+			}
+			err = replaceSrcset(opts, base, s)
+			return err == nil
+		}
+
 		attr := "src"
 		if s.Is("link") {
 			attr = "href"
 		}
-
-		path, ok := s.Attr(attr)
-		if !ok {
-			return true
+		if opts.SVG == SVGInline && s.Is("img") {
+			var ok bool
+			ok, err = inlineSVG(opts, base, s)
+			if err != nil {
+				return false
+			}
+			if ok {
+				return true
+			}
+		}
+		if srcset, ok := s.Attr("srcset"); ok && s.Is("img") {
+			if opts.Srcset != SrcsetSrc {
+				err = replaceSrcset(opts, base, s)
+				if err != nil {
+					return false
+				}
+			} else {
+				if _, ok := s.Attr("src"); !ok {
+					if c := largestCandidate(parseSrcset(srcset)); c.url != "" {
+						s.SetAttr("src", c.url)
+					}
+				}
+				s.RemoveAttr("srcset")
+				s.RemoveAttr("sizes")
+			}
 		}
-		path = opts.Root + path
 
-		if strings.HasPrefix(path, "data:") {
+		ref, ok := s.Attr(attr)
+		if !ok {
 			return true
 		}
-		if isRemote(path) && !opts.Remote.Has(Image) {
-			return true
+		var data string
+		data, err = inlineImg(opts, base, ref)
+		if err != nil {
+			return false
 		}
-		if !isRemote(path) && !opts.Local.Has(Image) {
-			return true
+		if data != "" {
+			s.SetAttr(attr, data)
 		}
+		return true
+	})
 
-		var f []byte
-		f, err = readPath(path)
-		cont, err = warn(opts, err)
+	return err
+}
+
+// Inline the candidates in the srcset attribute of s.
+func replaceSrcset(opts Options, base *url.URL, s *goquery.Selection) error {
+	cands := selectSrcset(parseSrcset(s.AttrOr("srcset", "")), opts.Srcset, opts.SrcsetDescriptor)
+	for i := range cands {
+		data, err := inlineImg(opts, base, cands[i].url)
 		if err != nil {
-			return false
+			return err
 		}
-		if !cont {
-			return true
+		if data != "" {
+			cands[i].url = data
 		}
+	}
+	s.SetAttr("srcset", formatSrcset(cands))
+	return nil
+}
+
+// Get the image ref as a data: URI.
+//
+// This returns "" if the image isn't inlined because of the Local and Remote
+// options, or if there was a non-fatal error.
+func inlineImg(opts Options, base *url.URL, ref string) (string, error) {
+	return inlineData(opts, base, ref, Image, 0)
+}
 
-		m := mime.TypeByExtension(filepath.Ext(path))
+// Get ref as a data: URI, if kind is enabled in Local or Remote.
+//
+// This returns "" if it's not inlined because of the Local and Remote options,
+// if it's larger than maxSize bytes (if maxSize > 0), or if there was a
+// non-fatal error.
+func inlineData(opts Options, base *url.URL, ref string, kind zint.Bitflag16, maxSize int64) (string, error) {
+	u, err := resolve(base, ref)
+	cont, err := warn(opts, err)
+	if err != nil || !cont || u == nil {
+		return "", err
+	}
+
+	if isRemoteURL(u) && !opts.Remote.Has(kind) {
+		return "", nil
+	}
+	if !isRemoteURL(u) && !opts.Local.Has(kind) {
+		return "", nil
+	}
+	// Don't fetch attachments that are filtered out by their extension; the
+	// type is checked again once it's fetched.
+	if kind == Attachment {
+		p := opts.fetchPath(u)
+		if m := guessType(p); m != "" && !opts.isAttachmentType(p, m) {
+			return "", nil
+		}
+	}
+
+	res, err := opts.fetchMax(u, maxSize)
+	cont, err = warn(opts, err)
+	if err != nil || !cont {
+		return "", err
+	}
+
+	m := res.MediaType()
+	if m == "" {
+		m = extTypes[strings.ToLower(path.Ext(stripQuery(res.URL)))]
+	}
+	if kind == Attachment {
 		if m == "" {
-			cont, err = warn(opts, &ParseError{Path: path, Err: errors.New("could not find MIME type")})
+			m, _, _ = mime.ParseMediaType(http.DetectContentType(res.Data))
+		}
+		if !opts.isAttachmentType(res.URL, m) {
+			return "", nil
+		}
+	}
+
+	if m == "" {
+		cont, err = warn(opts, &ParseError{Path: res.URL, Err: errors.New("could not find MIME type")})
+		if err != nil || !cont {
+			return "", err
+		}
+	}
+
+	return opts.process(fmt.Sprintf("data %d", kind), res.URL, "", func() (string, error) {
+		if m == svgType && kind != Attachment { // Attachments are kept as-is.
+			svg, err := processSVG(opts, u, res)
 			if err != nil {
-				return false
-			}
-			if !cont {
-				return true
+				return "", err
 			}
+			return svgDataURI(opts, svg), nil
 		}
-
-		s.SetAttr(attr, fmt.Sprintf("data:%v;base64,%v",
-			m, base64.StdEncoding.EncodeToString(f)))
-		return true
+		return fmt.Sprintf("data:%v;base64,%v", m, base64.StdEncoding.EncodeToString(res.Data)), nil
 	})
+}
 
-	return err
+// Media types for extensions that aren't in Go's builtin table, and often
+// missing from the system's.
+var extTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".weba": "audio/webm",
+	".vtt":  "text/vtt",
+	".csv":  "text/csv",
+	".tsv":  "text/tab-separated-values",
+	".zip":  "application/zip",
 }
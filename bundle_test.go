@@ -1,11 +1,15 @@
 package singlepage
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"zgo.at/zstd/ztest"
@@ -22,6 +26,21 @@ func TestNewOptions(t *testing.T) {
 			Local:  CSS,
 			Minify: CSS | JS,
 		}},
+		{"./", []string{"css", "media"}, []string{"video"}, nil, Options{
+			Root:   "./",
+			Local:  CSS | Media,
+			Remote: Media,
+		}},
+		{"./", []string{"iframe"}, []string{"frames", "img"}, nil, Options{
+			Root:   "./",
+			Local:  Frame,
+			Remote: Frame | Image,
+		}},
+		{"./", []string{"attachments"}, []string{"download"}, nil, Options{
+			Root:   "./",
+			Local:  Attachment,
+			Remote: Attachment,
+		}},
 	}
 
 	for i, tt := range tests {
@@ -39,29 +58,6 @@ func TestNewOptions(t *testing.T) {
 	}
 }
 
-func TestReadFile(t *testing.T) {
-	tests := []struct {
-		in, want string
-	}{
-		{"./bundle_test.go", "package singlepage"},
-		{"//example.com", "<!doctype html>"},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.in, func(t *testing.T) {
-			out, err := readPath(tt.in)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			o := string(bytes.Split(out, []byte("\n"))[0])
-			if o != tt.want {
-				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
-			}
-		})
-	}
-}
-
 func TestReplaceJS(t *testing.T) {
 	tests := []struct {
 		in, want string
@@ -92,6 +88,85 @@ func TestReplaceJS(t *testing.T) {
 			Options{Local: JS},
 			"",
 		},
+		{
+			`<script src="./testdata/a.js" type="module" id="x" nonce="abc" crossorigin="anonymous" referrerpolicy="no-referrer" onerror="alert(&#34;x&#34;)" integrity="sha256-x" data-x="y"></script>`,
+			`<script type="module" id="x" nonce="abc" crossorigin="anonymous" referrerpolicy="no-referrer" onerror="alert(&#34;x&#34;)" data-x="y">var foo={t:!0}</script>`,
+			Options{Local: JS, Minify: JS},
+			"",
+		},
+		{
+			`<script src="./testdata/a.js" nomodule="" integrity="sha256-x" crossorigin="anonymous"></script>`,
+			`<script nomodule="">var foo={t:!0}</script>`,
+			Options{Local: JS, Minify: JS, ScriptDropAttr: []string{"crossorigin"}},
+			"",
+		},
+		{
+			`<script>var x = 1 ;</script><script type="text/javascript; charset=utf-8">var x = 1 ;</script>`,
+			`<script>var x=1</script><script type="text/javascript; charset=utf-8">var x=1</script>`,
+			Options{Local: JS, Minify: JS},
+			"",
+		},
+		{
+			`<script type="application/ld+json">{ "@type": "Person",  "name": "x" }</script>` +
+				`<script type="importmap">{ "imports": { "a": "./a.js" } }</script>`,
+			`<script type="application/ld+json">{"@type":"Person","name":"x"}</script>` +
+				`<script type="importmap">{"imports":{"a":"./a.js"}}</script>`,
+			Options{Local: JS, Minify: JS},
+			"",
+		},
+		{
+			`<script type="text/template"><p>{{ if .x }} x </p></script>` +
+				`<script type="text/x-handlebars">  {{#each x}} </script>`,
+			`<script type="text/template"><p>{{ if .x }} x </p></script>` +
+				`<script type="text/x-handlebars">  {{#each x}} </script>`,
+			Options{Local: JS, Minify: JS},
+			"",
+		},
+		{
+			`<script type="Text/X-Handlebars">  {{#each x}} </script><script type="text/other"> x </script>`,
+			`<script type="Text/X-Handlebars">{{#each x}}</script><script type="text/other"> x </script>`,
+			Options{Local: JS, Minify: JS, ScriptHandlers: map[string]func(string) (string, error){
+				"text/x-handlebars": func(s string) (string, error) { return strings.TrimSpace(s), nil },
+			}},
+			"",
+		},
+		{
+			`<script src="./testdata/end.js"></script><script type="application/json" src="./testdata/end.js"></script>`,
+			"<script>var s = \"<\\/script><b>x</b>\";\n// <\\!-- <script>\n</script>" +
+				"<script type=\"application/json\">var s = \"\\u003c/script><b>x</b>\";\n// \\u003c!-- <script>\n</script>",
+			Options{Local: JS},
+			"",
+		},
+		{
+			`<script src="./testdata/end.js"></script>`,
+			`<script>var s="<\/script><b>x</b>"</script>`,
+			Options{Local: JS, Minify: JS},
+			"",
+		},
+		{
+			`<script type="text/template" src="./testdata/end.js"></script>`,
+			`<script type="text/template" src="./testdata/end.js"></script>`,
+			Options{Local: JS, Quiet: true},
+			"",
+		},
+		{
+			`<script src="/a.js"></script>`,
+			`<script>var foo={t:!0}</script>`,
+			Options{Root: "testdata/", Local: JS, Minify: JS},
+			"",
+		},
+		{
+			`<script src="../a.js"></script>`,
+			`<script>var foo={t:!0}</script>`,
+			Options{Root: "./testdata", Local: JS, Minify: JS},
+			"",
+		},
+		{
+			`<script src="https://example.com/a.js"></script>`,
+			`<script src="https://example.com/a.js"></script>`,
+			Options{Root: "./testdata", Local: JS},
+			"",
+		},
 		{
 			`<script src="./testdata/nonexist.js"></script>`,
 			`<script src="./testdata/nonexist.js"></script>`,
@@ -128,6 +203,8 @@ func TestReplaceJS(t *testing.T) {
 	}
 }
 
+const aB64 = `iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAIAAACQd1PeAAAACXBIWXMAAAsTAAALEwEAmpwYAAAAB3RJTUUH4QsYBTofXds9gQAAAAZiS0dEAP8A/wD/oL2nkwAAAAxJREFUCB1jkPvPAAACXAEebXgQcwAAAABJRU5ErkJggg==`
+
 func TestReplaceImg(t *testing.T) {
 	tests := []struct {
 		in, want string
@@ -146,6 +223,54 @@ func TestReplaceImg(t *testing.T) {
 			Options{},
 			"",
 		},
+		{
+			`<img src="a.png" srcset="a.png 1x, img/bg.png 2x" sizes="50vw"/>`,
+			`<img src="data:image/png;base64,` + aB64 + `" srcset="data:image/png;base64,` + aB64 + ` 1x, data:image/png;base64,` + pngB64 + ` 2x" sizes="50vw"/>`,
+			Options{Root: "testdata", Local: Image},
+			"",
+		},
+		{
+			`<img src="a.png" srcset="a.png 1x, img/bg.png 2x"/>`,
+			`<img src="data:image/png;base64,` + aB64 + `" srcset="data:image/png;base64,` + pngB64 + ` 2x"/>`,
+			Options{Root: "testdata", Local: Image, Srcset: SrcsetLargest},
+			"",
+		},
+		{
+			`<img src="a.png" srcset="a.png 1x, img/bg.png 2x"/>`,
+			`<img src="data:image/png;base64,` + aB64 + `" srcset="data:image/png;base64,` + aB64 + ` 1x"/>`,
+			Options{Root: "testdata", Local: Image, Srcset: SrcsetMatch, SrcsetDescriptor: "1x"},
+			"",
+		},
+		{
+			`<img src="a.png" srcset="a.png 1x, img/bg.png 2x" sizes="50vw"/>`,
+			`<img src="data:image/png;base64,` + aB64 + `"/>`,
+			Options{Root: "testdata", Local: Image, Srcset: SrcsetSrc},
+			"",
+		},
+		{
+			`<img srcset="a.png 100w, img/bg.png 200w" sizes="50vw"/>`,
+			`<img src="data:image/png;base64,` + pngB64 + `"/>`,
+			Options{Root: "testdata", Local: Image, Srcset: SrcsetSrc},
+			"",
+		},
+		{
+			`<picture><source srcset="img/bg.png" media="(min-width: 800px)"/><img src="a.png"/></picture>`,
+			`<picture><source srcset="data:image/png;base64,` + pngB64 + `" media="(min-width: 800px)"/><img src="data:image/png;base64,` + aB64 + `"/></picture>`,
+			Options{Root: "testdata", Local: Image},
+			"",
+		},
+		{
+			`<picture><source srcset="img/bg.png" media="(min-width: 800px)"/><img src="a.png"/></picture>`,
+			`<picture><img src="data:image/png;base64,` + aB64 + `"/></picture>`,
+			Options{Root: "testdata", Local: Image, Srcset: SrcsetSrc},
+			"",
+		},
+		{
+			`<img srcset="nonexistent.png 1x, https://example.com/a.png 2x"/>`,
+			`<img srcset="nonexistent.png 1x, https://example.com/a.png 2x"/>`,
+			Options{Root: "testdata", Local: Image, Quiet: true},
+			"",
+		},
 	}
 
 	for _, tt := range tests {
@@ -210,3 +335,282 @@ func TestBundle(t *testing.T) {
 		})
 	}
 }
+
+func TestBase(t *testing.T) {
+	fetcher := FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+		if path == "https://example.com/docs/_static/a.js" {
+			return &Resource{Data: []byte("var a;")}, nil
+		}
+		return nil, &LookupError{Path: path, Err: errors.New("not found")}
+	})
+
+	tests := []struct {
+		in, want string
+		opts     Options
+	}{
+		{
+			`<base href="img/"/></head><body><img src="bg.png"/>`,
+			`<base href="img/"/></head><body><img src="data:image/png;base64,` + pngB64 + `"/>`,
+			Options{Root: "testdata", Local: Image},
+		},
+		{
+			`<base href="img/"/></head><body><img src="bg.png"/>`,
+			`</head><body><img src="data:image/png;base64,` + pngB64 + `"/>`,
+			Options{Root: "testdata", Local: Image, Base: BaseRemove},
+		},
+		{
+			`<base href="img/" target="_blank"/></head><body><img src="bg.png"/>`,
+			`<base target="_blank"/></head><body><img src="data:image/png;base64,` + pngB64 + `"/>`,
+			Options{Root: "testdata", Local: Image, Base: BaseRemove},
+		},
+		{
+			`<base href="img/"/></head><body><img src="bg.png"/>`,
+			`<base href="img/"/></head><body><img src="data:image/png;base64,` + pngB64 + `"/>`,
+			Options{Root: "testdata", Local: Image, Base: BaseRewrite},
+		},
+		{
+			`<base href="/docs/index.html"/></head><body><script src="_static/a.js"></script>`,
+			`<base href="https://example.com/docs/index.html"/></head><body><script>var a;</script>`,
+			Options{Root: "https://example.com/other", Remote: JS, Base: BaseRewrite, Fetcher: fetcher},
+		},
+		{
+			`<base href="https://example.com/docs/"/></head><body><script src="_static/a.js"></script>`,
+			`</head><body><script>var a;</script>`,
+			Options{Remote: JS, Base: BaseRemove, Fetcher: fetcher},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.in = `<html><head>` + tt.in + `</body></html>`
+			tt.want = `<html><head>` + tt.want + `</body></html>`
+
+			o, err := Bundle([]byte(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+}
+
+func TestBundleContext(t *testing.T) {
+	html := []byte(`<html><head><script src="a.js"></script><script src="b.js"></script></head><body></body></html>`)
+	block := FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+		<-ctx.Done()
+		return nil, &LookupError{Path: path, Err: ctx.Err()}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+		_, err := BundleContext(ctx, html, Options{Local: JS, Fetcher: block})
+		if err != context.Canceled {
+			t.Errorf("wrong error: %#v", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		for _, p := range []int{1, 8} {
+			start := time.Now()
+			_, err := Bundle(html, Options{Local: JS, Fetcher: block, Timeout: 20 * time.Millisecond, Parallel: p})
+			if err != context.DeadlineExceeded {
+				t.Errorf("wrong error: %#v", err)
+			}
+			if time.Since(start) > time.Second {
+				t.Errorf("took too long: %s", time.Since(start))
+			}
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := BundleContext(ctx, html, Options{Local: JS, Fetcher: block})
+		if err != context.Canceled {
+			t.Errorf("wrong error: %#v", err)
+		}
+	})
+}
+
+func TestBundler(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetched = make(map[string]int)
+	)
+	opts := Options{
+		Local:  CSS | JS | Image,
+		Minify: CSS | JS,
+		Fetcher: FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+			mu.Lock()
+			fetched[path]++
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			switch path {
+			case "style.css":
+				return &Resource{Data: []byte(`div { background: url(bg.png); }`)}, nil
+			case "app.js":
+				return &Resource{Data: []byte(`var x = 1 + 1;`)}, nil
+			}
+			return &Resource{Data: []byte("PNG")}, nil
+		}),
+	}
+
+	doc := func(i int) string {
+		return fmt.Sprintf(`<html><head><link rel="stylesheet" href="style.css"><script src="app.js"></script></head>`+
+			`<body><p>%d</p><img src="bg.png"></body></html>`, i)
+	}
+	want := func(i int) string {
+		return fmt.Sprintf(`<html><head><style>div{background:url(data:image/png,PNG)}</style><script>var x=1+1</script></head>`+
+			`<body><p>%d</p><img src="data:image/png;base64,UE5H"/></body></html>`, i)
+	}
+
+	b := NewBundler(opts)
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var (
+				out string
+				err error
+			)
+			switch i % 3 {
+			case 0:
+				out, err = b.Bundle([]byte(doc(i)))
+			case 1:
+				out, err = b.BundleReader(strings.NewReader(doc(i)))
+			default:
+				out, err = b.BundleReaderContext(context.Background(), strings.NewReader(doc(i)))
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			if out != want(i) {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, want(i))
+			}
+		}()
+	}
+	wg.Wait()
+
+	wantFetched := map[string]int{"style.css": 1, "app.js": 1, "bg.png": 1}
+	if !reflect.DeepEqual(fetched, wantFetched) {
+		t.Errorf("\nout:  %#v\nwant: %#v\n", fetched, wantFetched)
+	}
+}
+
+// Processed resources shouldn't depend on the documents bundled before.
+func TestBundlerState(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m.js":        {Data: []byte(`import "./dep.js"`)},
+		"a.js":        {Data: []byte(`var a`)},
+		"b.js":        {Data: []byte(`var b`)},
+		"a.svg":       {Data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"><image href="b.svg"/></svg>`)},
+		"b.svg":       {Data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"><image href="a.svg"/></svg>`)},
+		"loop/a.html": {Data: []byte(`<iframe src="b.html"></iframe>`)},
+		"loop/b.html": {Data: []byte(`<iframe src="a.html"></iframe>`)},
+	}
+	tests := []struct {
+		docs []string
+		opts Options
+	}{
+		{[]string{
+			`<script type="importmap">{"imports": {"./dep.js": "./a.js"}}</script><script type="module" src="m.js"></script>`,
+			`<script type="importmap">{"imports": {"./dep.js": "./b.js"}}</script><script type="module" src="m.js"></script>`,
+		}, Options{Local: JS}},
+		{[]string{`<img src="a.svg">`, `<img src="b.svg">`}, Options{Local: Image}},
+		{[]string{`<iframe src="loop/a.html"></iframe>`, `<iframe src="loop/b.html"></iframe>`}, Options{Local: Frame}},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.opts.Quiet, tt.opts.Fetcher = true, FSFetcher{FS: fsys}
+			b := NewBundler(tt.opts)
+			for _, d := range tt.docs {
+				want, err := Bundle([]byte(d), tt.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out, err := b.Bundle([]byte(d))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if out != want {
+					t.Errorf("\nout:  %#v\nwant: %#v\n", out, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDefer(t *testing.T) {
+	in := `<html><head>` +
+		`<script src="./testdata/a.js" defer></script>` +
+		`<script src="./testdata/a.js" async id="a"></script>` +
+		`<script src="./testdata/a.js" type="module"></script>` +
+		`<script src="./testdata/a.js" id="sync"></script>` +
+		`</head><body><p>x</p></body></html>`
+
+	tests := []struct {
+		mode DeferMode
+		want string
+	}{
+		{DeferMove, `<html><head>` +
+			`<script type="module">var foo={t:!0}</script>` +
+			`<script id="sync">var foo={t:!0}</script>` +
+			`</head><body><p>x</p>` +
+			`<script>var foo={t:!0}</script>` +
+			`<script id="a">var foo={t:!0}</script>` +
+			`</body></html>`},
+		{DeferEvent, `<html><head>` +
+			`<script>document.addEventListener("DOMContentLoaded",function(){var foo={t:!0}` + "\n" + `})</script>` +
+			`<script id="a">document.addEventListener("DOMContentLoaded",function(){var foo={t:!0}` + "\n" + `})</script>` +
+			`<script type="module">var foo={t:!0}</script>` +
+			`<script id="sync">var foo={t:!0}</script>` +
+			`</head><body><p>x</p></body></html>`},
+		{DeferKeep, `<html><head>` +
+			`<script defer="">var foo={t:!0}</script>` +
+			`<script async="" id="a">var foo={t:!0}</script>` +
+			`<script type="module">var foo={t:!0}</script>` +
+			`<script id="sync">var foo={t:!0}</script>` +
+			`</head><body><p>x</p></body></html>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v", tt.mode), func(t *testing.T) {
+			o, err := Bundle([]byte(in), Options{Local: JS, Minify: JS, Defer: tt.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+
+	// Deferred scripts that aren't inlined are moved too, so they still run
+	// before later deferred scripts.
+	t.Run("not inlined", func(t *testing.T) {
+		o, err := Bundle([]byte(`<html><head>`+
+			`<script src="https://cdn.example.com/lib.js" defer></script>`+
+			`<script src="./testdata/nonexist.js" async></script>`+
+			`<script src="./testdata/a.js" defer></script>`+
+			`</head><body><p>x</p></body></html>`), Options{Local: JS, Minify: JS, Defer: DeferMove, Quiet: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `<html><head></head><body><p>x</p>` +
+			`<script src="https://cdn.example.com/lib.js"></script>` +
+			`<script src="./testdata/nonexist.js"></script>` +
+			`<script>var foo={t:!0}</script>` +
+			`</body></html>`
+		if o != want {
+			t.Errorf("\nout:  %#v\nwant: %#v\n", o, want)
+		}
+	})
+}
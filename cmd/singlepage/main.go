@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"zgo.at/singlepage"
 	"zgo.at/zli"
@@ -31,19 +35,71 @@ Flags:
 
     -w, -write     Write the result to the input file instead of printing it.
 
-    -r, -root      Assets are looked up relative to the path in -root, which may
-                   be a remote path (e.g. http://example.com), in which case all
-                   "//resources" are fetched relative to that domain (and are
-                   treated as external).
+    -r, -root      Assets are looked up relative to the directory in -root,
+                   which may be a remote path (e.g. http://example.com/docs/),
+                   in which case all relative references are fetched from there
+                   (and are treated as external). References starting with "/"
+                   are relative to -root for local directories, and relative to
+                   the domain for remote ones.
+
+    -b, -base      What to do with the document's <base href=".."> element
+                   once everything is bundled: "keep" it (the default),
+                   "remove" it, or "rewrite" it to an absolute URL if it's
+                   remote, so links keep working.
+
+    -d, -defer     How to emulate the execution order of inlined <script defer>
+                   and <script async>: "keep" them where they are (the
+                   default), "move" them to the end of the body, or wrap them
+                   in a DOMContentLoaded "event" handler.
+
+    -s, -srcset    How to inline srcset attributes on <img> and <picture><source>:
+                   inline "all" candidates (the default), only the "largest"
+                   one, collapse it to just the "src", or a descriptor such
+                   as "2x" or "800w" to keep only that candidate.
+
+    -svg           How to inline SVG images: as a "base64" data: URI like other
+                   images (the default), as a smaller percent-encoded "utf8"
+                   data: URI, or "inline" <img> elements as <svg>.
+
+    -p, -parallel  Maximum number of assets to fetch concurrently. Default: 8.
+
+    -t, -timeout   Maximum time to spend on bundling the document, as a duration
+                   such as "30s" or "2m". Default: no limit.
+
+    -c, -cache     Directory to cache remote assets in. Cached assets are
+                   revalidated with the ETag and Last-Modified headers.
+
+    -o, -offline   Never fetch remote assets over the network, but only use
+                   what's in the -cache directory.
 
     -l, -local     Filetypes to include from the local filesystem. Supports css,
-                   js, img, and font.
+                   js, img, font, media (video, audio, and subtitles), frame
+                   (<iframe> documents, which are bundled with the same options
+                   and stored in srcdoc), and attachment (<a download>,
+                   <object>, and <embed>).
 
     -r, -remote    Filetypes to include from remote sources. Only only
                    "http://", "https://", and "//" are supported; "//" is
-                   treated as "https://". Suports css, js, img, and font.
-
-    -m, -minify    Filetypes to minify. Support js, css, and html.
+                   treated as "https://". Suports css, js, img, font, media,
+                   frame, and attachment. Frames from a different origin than
+                   the document are only bundled if the <iframe> has a sandbox
+                   attribute without allow-same-origin.
+
+    -M, -max-media Maximum size of media files to inline, in bytes. Default: no
+                   limit.
+
+    -A, -max-attachment
+                   Maximum size of attachments to inline, in bytes. Default: no
+                   limit.
+
+    -attachment-types
+                   Comma-separated list of attachment types to inline, as
+                   extensions (".pdf") or media types ("text/csv", "image/*").
+                   Default: common document, data, and archive types, as well
+                   as images, audio, and video.
+
+    -m, -minify    Filetypes to minify. Support js, css, html, and img (only
+                   SVG images are minified). Default: css,js,html.
 `
 
 func fatal(err error) {
@@ -65,9 +121,20 @@ func main() {
 		strict   = f.Bool(false, "S", "strict")
 		write    = f.Bool(false, "w", "write")
 		root     = f.String("", "r", "root", "")
+		base     = f.String("keep", "b", "base")
+		deferF   = f.String("keep", "d", "defer")
+		srcset   = f.String("all", "s", "srcset")
+		svg      = f.String("base64", "svg")
+		parallel = f.Int(8, "p", "parallel")
+		timeout  = f.String("", "t", "timeout")
+		cache    = f.String("", "c", "cache")
+		offline  = f.Bool(false, "o", "offline")
 		local    = f.StringList([]string{"css,js,img"}, "l", "local")
 		remote   = f.StringList([]string{"css,js,img"}, "r", "remote")
 		minify   = f.StringList([]string{"css,js,html"}, "m", "minify")
+		maxMedia = f.Int(0, "M", "max-media")
+		maxAtt   = f.Int(0, "A", "max-attachment")
+		attTypes = f.StringList(nil, "attachment-types")
 	)
 	fatal(f.Parse())
 
@@ -84,6 +151,65 @@ func main() {
 	opts := singlepage.NewOptions(root.String(), strict.Bool(), quiet.Bool())
 	err := opts.Commandline(local.StringsSplit(","), remote.StringsSplit(","), minify.StringsSplit(","))
 	fatal(err)
+	opts.Parallel = parallel.Int()
+	opts.MaxMediaSize = int64(maxMedia.Int())
+	opts.MaxAttachmentSize = int64(maxAtt.Int())
+	if attTypes.Set() {
+		opts.AttachmentTypes = attTypes.StringsSplit(",")
+	}
+	if offline.Bool() && cache.String() == "" {
+		fatal(errors.New("-offline requires -cache"))
+	}
+	if cache.String() != "" || offline.Bool() {
+		opts.Fetcher = &singlepage.DefaultFetcher{CacheDir: cache.String(), Offline: offline.Bool(), Quiet: quiet.Bool()}
+	}
+	if timeout.String() != "" {
+		opts.Timeout, err = time.ParseDuration(timeout.String())
+		fatal(err)
+	}
+	switch base.String() {
+	case "keep":
+		opts.Base = singlepage.BaseKeep
+	case "remove":
+		opts.Base = singlepage.BaseRemove
+	case "rewrite":
+		opts.Base = singlepage.BaseRewrite
+	default:
+		fatal(fmt.Errorf("unknown value for -base: %q", base.String()))
+	}
+	switch deferF.String() {
+	case "move":
+		opts.Defer = singlepage.DeferMove
+	case "event":
+		opts.Defer = singlepage.DeferEvent
+	case "keep":
+		opts.Defer = singlepage.DeferKeep
+	default:
+		fatal(fmt.Errorf("unknown value for -defer: %q", deferF.String()))
+	}
+	switch svg.String() {
+	case "base64":
+		opts.SVG = singlepage.SVGBase64
+	case "utf8":
+		opts.SVG = singlepage.SVGDataURI
+	case "inline":
+		opts.SVG = singlepage.SVGInline
+	default:
+		fatal(fmt.Errorf("unknown value for -svg: %q", svg.String()))
+	}
+	switch srcset.String() {
+	case "all":
+		opts.Srcset = singlepage.SrcsetAll
+	case "largest":
+		opts.Srcset = singlepage.SrcsetLargest
+	case "src":
+		opts.Srcset = singlepage.SrcsetSrc
+	default:
+		if !strings.HasSuffix(srcset.String(), "x") && !strings.HasSuffix(srcset.String(), "w") {
+			fatal(fmt.Errorf("unknown value for -srcset: %q", srcset.String()))
+		}
+		opts.Srcset, opts.SrcsetDescriptor = singlepage.SrcsetMatch, srcset.String()
+	}
 
 	path := f.Shift()
 	if path == "" && write.Bool() {
@@ -97,7 +223,9 @@ func main() {
 	b, err := io.ReadAll(fp)
 	fatal(err)
 
-	html, err := singlepage.Bundle(b, opts)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	html, err := singlepage.BundleContext(ctx, b, opts)
 	fatal(err)
 
 	if write.Bool() {
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"mime"
+	"net/url"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
@@ -15,28 +17,46 @@ import (
 
 // Replace <link rel="stylesheet" href="/_static/style.css"> with
 // <style>..</style>
+//
+// Attributes such as media and title are copied to the <style> element.
+// Alternate and disabled stylesheets are kept as a <link> with a data: URI, as
+// they would be applied if they were changed to a <style>.
 func replaceCSSLinks(doc *goquery.Document, opts Options) (err error) {
 	if !opts.Local.Has(CSS) && !opts.Remote.Has(CSS) {
 		return nil
 	}
 
+	base, err := opts.baseURL()
+	if err != nil {
+		return err
+	}
+
 	var cont bool
-	doc.Find(`link[rel="stylesheet"]`).EachWithBreak(func(i int, s *goquery.Selection) bool {
-		path, ok := s.Attr("href")
+	doc.Find(`link[rel~="stylesheet" i]`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		ref, ok := s.Attr("href")
 		if !ok {
 			return true
 		}
-		path = opts.Root + path
 
-		if isRemote(path) && !opts.Remote.Has(CSS) {
+		var u *url.URL
+		u, err = resolve(base, ref)
+		cont, err = warn(opts, err)
+		if err != nil {
+			return false
+		}
+		if !cont || u == nil {
+			return true
+		}
+
+		if isRemoteURL(u) && !opts.Remote.Has(CSS) {
 			return true
 		}
-		if !isRemote(path) && !opts.Local.Has(CSS) {
+		if !isRemoteURL(u) && !opts.Local.Has(CSS) {
 			return true
 		}
 
-		var f []byte
-		f, err = readPath(path)
+		var res *Resource
+		res, err = opts.fetch(u)
 		cont, err = warn(opts, err)
 		if err != nil {
 			return false
@@ -45,101 +65,159 @@ func replaceCSSLinks(doc *goquery.Document, opts Options) (err error) {
 			return true
 		}
 
-		// Replace @imports
 		var out string
-		out, err = replaceCSSURLs(opts, string(f))
+		out, err = opts.process("css", res.URL, "", func() (string, error) {
+			// Replace @imports
+			out, err := replaceCSSURLs(opts, resourceURL(u, res), string(res.Data), newImports(opts, u))
+			if err != nil {
+				return "", fmt.Errorf("could not parse %v: %v", res.URL, err)
+			}
+
+			if opts.Minify.Has(CSS) {
+				out, err = minifier.String("css", out)
+				if err != nil {
+					return "", fmt.Errorf("could not minify %v: %v", res.URL, err)
+				}
+			}
+			return out, nil
+		})
 		if err != nil {
-			err = fmt.Errorf("could not parse %v: %v", path, err)
 			return false
 		}
 
-		if opts.Minify.Has(CSS) {
-			out, err = minifier.String("css", out)
-			if err != nil {
-				err = fmt.Errorf("could not minify %v: %v", path, err)
-				return false
-			}
+		_, disabled := s.Attr("disabled")
+		if disabled || hasToken(s.AttrOr("rel", ""), "alternate") {
+			s.SetAttr("href", "data:text/css;base64,"+base64.StdEncoding.EncodeToString([]byte(out)))
+			s.RemoveAttr("integrity")
+			s.RemoveAttr("crossorigin")
+			return true
 		}
 
-		s.AfterHtml("<style>" + out + "</style>")
+		s.AfterHtml("<style" + formatAttr(s.Nodes[0].Attr, linkOnlyAttr...) + ">" + escapeStyle(out) + "</style>")
 		s.Remove()
 		return true
 	})
 	return err
 }
 
+// Attributes that make no sense on a <style> element.
+var linkOnlyAttr = []string{"rel", "href", "hreflang", "integrity", "crossorigin",
+	"referrerpolicy", "as", "sizes", "fetchpriority", "charset", "type"}
+
 // Replace @import "path"; and url("..")
 func replaceCSSImports(doc *goquery.Document, opts Options) (err error) {
 	if !opts.Local.Has(CSS) && !opts.Remote.Has(CSS) {
 		return nil
 	}
 
+	base, err := opts.baseURL()
+	if err != nil {
+		return err
+	}
+
 	doc.Find("style").EachWithBreak(func(i int, s *goquery.Selection) bool {
 		var n string
-		n, err = replaceCSSURLs(opts, s.Text())
+		n, err = replaceCSSURLs(opts, base, s.Text(), newImports(opts, nil))
 		if err != nil {
 			err = fmt.Errorf("could not parse inline style block %v: %v", i, err)
 			return false
 		}
-		s.SetHtml(n)
+		s.SetHtml(escapeStyle(n))
+		return true
+	})
+	return err
+}
+
+// Replace url()s in style="" attributes, and minify them.
+func replaceStyleAttrs(doc *goquery.Document, opts Options) (err error) {
+	inline := opts.Local.Has(CSS) || opts.Remote.Has(CSS)
+	if !inline && !opts.Minify.Has(CSS) {
+		return nil
+	}
+
+	base, err := opts.baseURL()
+	if err != nil {
+		return err
+	}
+
+	doc.Find("[style]").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		st := s.AttrOr("style", "")
+		if inline {
+			st, err = replaceCSSURLs(opts, base, st, newImports(opts, nil))
+			if err != nil {
+				err = fmt.Errorf("could not parse style attribute on <%s>: %v", goquery.NodeName(s), err)
+				return false
+			}
+		}
+		if opts.Minify.Has(CSS) {
+			var min string
+			min, err = minifier.String("css;inline=1", st)
+			if err != nil { // Keep the attribute as-is.
+				_, err = warn(opts, &ParseError{Path: opts.fetchPath(base), Err: fmt.Errorf(
+					"could not minify style attribute on <%s>: %v", goquery.NodeName(s), err)})
+				if err != nil {
+					return false
+				}
+				min = st
+			}
+			st = min
+		}
+		s.SetAttr("style", st)
 		return true
 	})
 	return err
 }
 
-func replaceCSSURLs(opts Options, s string) (string, error) {
+// Inline the @imports and url()s in the stylesheet s.
+//
+// References are resolved relative to base, which should be the location of the
+// stylesheet (or the document for inline styles).
+//
+// imp is used to keep track of the @import chain.
+func replaceCSSURLs(opts Options, base *url.URL, s string, imp *imports) (string, error) {
 	l := css.NewLexer(parse.NewInputString(s))
-	var out []byte
-	var cont bool
+	var (
+		out  []byte
+		imps []pendingImport
+		cont bool
+	)
 	for {
 		tt, text := l.Next()
 		switch {
 
 		case tt == css.ErrorToken:
-			if l.Err() == io.EOF {
-				return string(out), nil
+			if l.Err() != io.EOF {
+				return string(out), l.Err()
 			}
-			return string(out), l.Err()
+			return inlineImports(opts, out, imps, imp)
 
 		// @import
 		case tt == css.AtKeywordToken && string(text) == "@import":
+			var rule []cssToken
 			for {
 				tt2, text2 := l.Next()
 				if tt2 == css.SemicolonToken {
 					break
 				}
 				if tt2 == css.ErrorToken {
+					if l.Err() == io.EOF {
+						break
+					}
 					return "", l.Err()
 				}
+				rule = append(rule, cssToken{tt2, string(text2)})
+			}
 
-				var path string
-				if tt2 == css.StringToken {
-					path = strings.Trim(string(text2), `'"`)
-				} else if tt2 == css.URLToken {
-					path = string(text2)
-					path = path[strings.Index(path, "(")+1 : strings.Index(path, ")")]
-					path = strings.Trim(path, `'"`)
-				} else {
-					continue
-				}
-
-				if path != "" {
-					b, err := readPath(path)
-					cont, err = warn(opts, err)
-					if err != nil {
-						return "", err
-					}
-					if !cont {
-						continue
-					}
-
-					nest, err := replaceCSSURLs(opts, string(b))
-					if err != nil {
-						return "", fmt.Errorf("could not load nested CSS file %v: %v", path, err)
-					}
-					out = append(out, []byte(nest)...)
-				}
+			path, cond := parseImport(rule)
+			u, err := resolve(base, path)
+			cont, err = warn(opts, err)
+			if err != nil {
+				return "", err
 			}
+			if !cont || u == nil {
+				continue
+			}
+			imps = append(imps, pendingImport{at: len(out), path: path, u: u, cond: cond})
 
 		// Images and fonts
 		case tt == css.URLToken:
@@ -151,14 +229,24 @@ func replaceCSSURLs(opts Options, s string) (string, error) {
 			}
 
 			path = strings.Trim(path, `'"`)
-			m := mime.TypeByExtension(filepath.Ext(path))
+			u, err := resolve(base, path)
+			cont, err = warn(opts, err)
+			if err != nil {
+				return "", err
+			}
+			if !cont || u == nil {
+				out = append(out, text...)
+				continue
+			}
+
+			m := mime.TypeByExtension(filepath.Ext(u.Path))
 			if m == "" {
 				warn(opts, fmt.Errorf("unknown MIME type for %q; skipping", path))
 				out = append(out, text...)
 				continue
 			}
 
-			remote := isRemote(path)
+			remote := isRemoteURL(u)
 			if strings.HasPrefix(m, "image/") &&
 				((remote && !opts.Remote.Has(Image)) || (!remote && !opts.Local.Has(Image))) {
 				out = append(out, text...)
@@ -169,20 +257,267 @@ func replaceCSSURLs(opts Options, s string) (string, error) {
 				continue
 			}
 
-			f, err := readPath(path)
+			res, err := opts.fetch(u)
 			cont, err = warn(opts, err)
 			if err != nil {
 				return "", err
 			}
 			if !cont {
+				out = append(out, text...)
 				continue
 			}
 
 			out = append(out, []byte(fmt.Sprintf("url(data:%v;base64,%v)",
-				m, base64.StdEncoding.EncodeToString(f)))...)
+				m, base64.StdEncoding.EncodeToString(res.Data)))...)
 
 		default:
 			out = append(out, text...)
 		}
 	}
 }
+
+// pendingImport is an @import that's yet to be inlined.
+type pendingImport struct {
+	at   int // Position in the output.
+	path string
+	u    *url.URL
+	cond importConditions
+	css  string
+}
+
+// Inline the @imports in out.
+//
+// A stylesheet that's imported more than once is applied again at every
+// @import in browsers, so the last @import determines where its rules are in
+// the cascade. The @imports are inlined in reverse order, so that only the
+// last one is kept and the earlier ones are removed.
+func inlineImports(opts Options, out []byte, imps []pendingImport, imp *imports) (string, error) {
+	for i := len(imps) - 1; i >= 0; i-- {
+		nestImp, err := imp.push(imps[i].u, imps[i].cond)
+		cont, err := warn(opts, err)
+		if err != nil {
+			return "", err
+		}
+		if !cont {
+			continue
+		}
+		if nestImp == nil {
+			// Still declare the layer here, as the first declaration
+			// determines the order of layers.
+			if l := imps[i].cond.layer; l != nil && *l != "" {
+				imps[i].css = imps[i].cond.wrap("")
+			}
+			continue
+		}
+
+		res, err := opts.fetch(imps[i].u)
+		cont, err = warn(opts, err)
+		if err != nil {
+			return "", err
+		}
+		if !cont {
+			continue
+		}
+
+		nest, err := replaceCSSURLs(opts, resourceURL(imps[i].u, res), string(res.Data), nestImp)
+		if err != nil {
+			return "", fmt.Errorf("could not load nested CSS file %v: %v", imps[i].path, err)
+		}
+		imps[i].css = imps[i].cond.wrap(nest)
+	}
+
+	var (
+		b    strings.Builder
+		prev int
+	)
+	for _, im := range imps {
+		b.Write(out[prev:im.at])
+		b.WriteString(im.css)
+		prev = im.at
+	}
+	b.Write(out[prev:])
+	return b.String(), nil
+}
+
+// imports keeps track of the @import chain of a stylesheet.
+type imports struct {
+	opts  Options
+	chain []string            // Current chain of stylesheets, from top to bottom.
+	cond  string              // Conditions on the chain, as CSS.
+	seen  map[string]struct{} // All imported stylesheets in the tree, by conditions and path.
+}
+
+// newImports starts a new import chain; sheet is the location of the top-level
+// stylesheet, or nil for inline <style> blocks.
+func newImports(opts Options, sheet *url.URL) *imports {
+	imp := &imports{opts: opts, seen: make(map[string]struct{})}
+	if sheet != nil {
+		p := opts.fetchPath(sheet)
+		imp.chain, imp.seen[importKey("", p)] = []string{p}, struct{}{}
+	}
+	return imp
+}
+
+// push a stylesheet to the import chain, returning the new chain.
+//
+// This returns a ParseError if the import is circular or nested too deeply, and
+// nil if the stylesheet was already imported elsewhere in the tree with the
+// same conditions (including those of all the @imports that lead to it).
+func (imp *imports) push(sheet *url.URL, c importConditions) (*imports, error) {
+	var (
+		p    = imp.opts.fetchPath(sheet)
+		cond = imp.cond + c.wrap("")
+		key  = importKey(cond, p)
+	)
+	if slices.Contains(imp.chain, p) {
+		return nil, &ParseError{Path: p, Err: fmt.Errorf("circular @import: %s",
+			strings.Join(append(imp.chain, p), " → "))}
+	}
+	if _, ok := imp.seen[key]; ok {
+		return nil, nil
+	}
+	if len(imp.chain) >= imp.opts.maxImportDepth() {
+		return nil, &ParseError{Path: p, Err: fmt.Errorf("@import nested more than %d levels deep: %s",
+			imp.opts.maxImportDepth(), strings.Join(append(imp.chain, p), " → "))}
+	}
+
+	imp.seen[key] = struct{}{}
+	return &imports{
+		opts:  imp.opts,
+		chain: append(slices.Clip(imp.chain), p),
+		cond:  cond,
+		seen:  imp.seen,
+	}, nil
+}
+
+func importKey(cond, path string) string { return cond + " " + path }
+
+func (opts Options) maxImportDepth() int {
+	if opts.MaxImportDepth < 1 {
+		return 16
+	}
+	return opts.MaxImportDepth
+}
+
+type cssToken struct {
+	tt   css.TokenType
+	text string
+}
+
+// importConditions are the conditions on an @import rule.
+type importConditions struct {
+	layer    *string // nil if there's no layer; "" for an anonymous layer.
+	supports string
+	media    string
+}
+
+// parseImport parses the tokens of an @import rule (without the @import
+// keyword and semicolon), returning the path and conditions.
+func parseImport(rule []cssToken) (string, importConditions) {
+	var (
+		path string
+		cond importConditions
+		i    int
+	)
+	for ; i < len(rule); i++ {
+		if rule[i].tt == css.WhitespaceToken || rule[i].tt == css.CommentToken {
+			continue
+		}
+		if rule[i].tt == css.StringToken {
+			path = strings.Trim(rule[i].text, `'"`)
+		} else if rule[i].tt == css.URLToken {
+			path = rule[i].text
+			path = path[strings.Index(path, "(")+1 : strings.LastIndex(path, ")")]
+			path = strings.TrimSpace(strings.Trim(strings.TrimSpace(path), `'"`))
+		}
+		i++
+		break
+	}
+
+	// Get the contents of a function, up to the matching ")".
+	function := func() string {
+		var (
+			b     strings.Builder
+			depth = 1
+		)
+		for i++; i < len(rule); i++ {
+			switch rule[i].tt {
+			case css.FunctionToken, css.LeftParenthesisToken:
+				depth++
+			case css.RightParenthesisToken:
+				depth--
+			}
+			if depth == 0 {
+				break
+			}
+			b.WriteString(rule[i].text)
+		}
+		return strings.TrimSpace(b.String())
+	}
+
+	var media strings.Builder
+	for ; i < len(rule); i++ {
+		t := rule[i]
+		switch {
+		case media.Len() == 0 && t.tt == css.WhitespaceToken:
+		case media.Len() == 0 && cond.layer == nil && cond.supports == "" &&
+			t.tt == css.IdentToken && strings.EqualFold(t.text, "layer"):
+			l := ""
+			cond.layer = &l
+		case media.Len() == 0 && cond.layer == nil && cond.supports == "" &&
+			t.tt == css.FunctionToken && strings.EqualFold(t.text, "layer("):
+			l := function()
+			cond.layer = &l
+		case media.Len() == 0 && cond.supports == "" &&
+			t.tt == css.FunctionToken && strings.EqualFold(t.text, "supports("):
+			cond.supports = function()
+		default:
+			media.WriteString(t.text)
+		}
+	}
+	cond.media = strings.TrimSpace(media.String())
+	return path, cond
+}
+
+// wrap the CSS in @media, @supports, and @layer blocks.
+func (c importConditions) wrap(s string) string {
+	if c.layer != nil {
+		if *c.layer == "" {
+			s = "@layer{" + s + "}"
+		} else {
+			s = "@layer " + *c.layer + "{" + s + "}"
+		}
+	}
+	if c.supports != "" {
+		// supports() can contain either a declaration or a condition;
+		// @supports needs parenthesis around declarations.
+		sup := c.supports
+		if isCSSDeclaration(sup) {
+			sup = "(" + sup + ")"
+		}
+		s = "@supports " + sup + "{" + s + "}"
+	}
+	if c.media != "" && !strings.EqualFold(c.media, "all") {
+		s = "@media " + c.media + "{" + s + "}"
+	}
+	return s
+}
+
+// Report if s looks like a declaration ("display: grid"), rather than a
+// condition ("(display: grid) and (not selector(:has(a)))").
+func isCSSDeclaration(s string) bool {
+	l := css.NewLexer(parse.NewInputString(s))
+	tt, _ := l.Next()
+	for tt == css.WhitespaceToken {
+		tt, _ = l.Next()
+	}
+	if tt != css.IdentToken {
+		return false
+	}
+	for {
+		tt, _ = l.Next()
+		if tt != css.WhitespaceToken {
+			return tt == css.ColonToken
+		}
+	}
+}
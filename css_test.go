@@ -1,11 +1,15 @@
 package singlepage
 
 import (
+	"context"
 	"fmt"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/PuerkitoBio/goquery"
+	"zgo.at/zstd/ztest"
 )
 
 func TestReplaceCSSLinks(t *testing.T) {
@@ -28,6 +32,36 @@ func TestReplaceCSSLinks(t *testing.T) {
 			`<link rel="stylesheet" href="./testdata/a.css"/>`,
 			Options{},
 		},
+		{
+			`<link rel="stylesheet" href="./testdata/a.css" media="print" title="Dark &amp; &#34;light&#34;" id="x" nonce="abc" integrity="sha256-x" crossorigin="anonymous">`,
+			`<style media="print" title="Dark &amp; &#34;light&#34;" id="x" nonce="abc">div{display:none}</style>`,
+			Options{Local: CSS, Minify: CSS},
+		},
+		{
+			`<link rel="Alternate StyleSheet" href="./testdata/a.css" title="Dark">`,
+			`<link rel="Alternate StyleSheet" href="data:text/css;base64,ZGl2e2Rpc3BsYXk6bm9uZX0=" title="Dark"/>`,
+			Options{Local: CSS, Minify: CSS},
+		},
+		{
+			`<link rel="stylesheet" href="./testdata/a.css" disabled integrity="sha256-x">`,
+			`<link rel="stylesheet" href="data:text/css;base64,ZGl2e2Rpc3BsYXk6bm9uZX0=" disabled=""/>`,
+			Options{Local: CSS, Minify: CSS},
+		},
+		{
+			`<link rel="stylesheet" href="./testdata/end.css">`,
+			"<style>/* <\\/style><b>x</b> */\ndiv { content: \"<\\/STYLE>\"; }\n</style>",
+			Options{Local: CSS},
+		},
+		{
+			`<link rel="stylesheet" href="./testdata/end.css">`,
+			`<style>div{content:"<\/STYLE>"}</style>`,
+			Options{Local: CSS, Minify: CSS},
+		},
+		{
+			`<link rel="stylesheet" href="/css/site.css">`,
+			`<style>p{background:url(data:image/png;base64,` + pngB64 + `)}body{background:url(data:image/png;base64,` + pngB64 + `)}</style>`,
+			Options{Root: "testdata", Local: CSS | Image, Minify: CSS},
+		},
 	}
 
 	for _, tt := range tests {
@@ -58,6 +92,43 @@ func TestReplaceCSSLinks(t *testing.T) {
 	}
 }
 
+func TestReplaceCSSURLsRemote(t *testing.T) {
+	var fetched []string
+	opts := Options{
+		Remote: CSS | Image,
+		Fetcher: FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+			fetched = append(fetched, path)
+			switch path {
+			case "https://example.com/static/css/site.css":
+				return &Resource{Data: []byte(`@import url(/x/y.css); div { background: url(../img/bg.png); }`)}, nil
+			case "https://example.com/x/y.css":
+				return &Resource{Data: []byte(`p { background: url(z.png); }`), URL: "https://cdn.example.com/x/y.css"}, nil
+			}
+			return &Resource{Data: []byte("x")}, nil
+		}),
+	}
+
+	base, _ := url.Parse("https://example.com/static/css/site.css")
+	out, err := replaceCSSURLs(opts, base, `@import "site.css";`, newImports(opts, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `p { background: url(data:image/png;base64,eA==); } div { background: url(data:image/png;base64,eA==); }`
+	if out != want {
+		t.Errorf("\nout:  %#v\nwant: %#v\n", out, want)
+	}
+	wantFetched := []string{
+		"https://example.com/static/css/site.css",
+		"https://example.com/static/img/bg.png",
+		"https://example.com/x/y.css",
+		"https://cdn.example.com/x/z.png",
+	}
+	if !reflect.DeepEqual(fetched, wantFetched) {
+		t.Errorf("\nout:  %#v\nwant: %#v\n", fetched, wantFetched)
+	}
+}
+
 func TestReplaceCSSImports(t *testing.T) {
 	tests := []struct {
 		in, want string
@@ -69,6 +140,10 @@ func TestReplaceCSSImports(t *testing.T) {
 			</style>`,
 			"<style>\n\t\t\t\tdiv {\n\tdisplay: none;\n}\n\n\t\t\t\tspan { display: block; }\n\t\t\t</style>",
 		},
+		{
+			`<style>@import './testdata/end.css';</style>`,
+			"<style>/* <\\/style><b>x</b> */\ndiv { content: \"<\\/STYLE>\"; }\n</style>",
+		},
 	}
 
 	for i, tt := range tests {
@@ -98,6 +173,60 @@ func TestReplaceCSSImports(t *testing.T) {
 	}
 }
 
+func TestReplaceStyleAttrs(t *testing.T) {
+	tests := []struct {
+		in, want string
+		opts     Options
+	}{
+		{
+			`<div style="background-image: url('img/bg.png'); color: red"></div>`,
+			`<div style="background-image: url(data:image/png;base64,` + pngB64 + `); color: red"></div>`,
+			Options{Root: "testdata", Local: CSS | Image},
+		},
+		{
+			`<div style="background-image: url('img/bg.png'); color: red"></div>`,
+			`<div style="background-image:url(data:image/png;base64,` + pngB64 + `);color:red"></div>`,
+			Options{Root: "testdata", Local: CSS | Image, Minify: CSS},
+		},
+		{
+			`<div style="background-image: url('img/bg.png'); color: red"></div>`,
+			`<div style="background-image:url(img/bg.png);color:red"></div>`,
+			Options{Root: "testdata", Minify: CSS},
+		},
+		{ // No Image
+			`<div style="background-image: url('img/bg.png')"></div>`,
+			`<div style="background-image: url(&#39;img/bg.png&#39;)"></div>`,
+			Options{Root: "testdata", Local: CSS},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.in = `<html><head></head><body>` + tt.in + `</body></html>`
+			tt.want = `<html><head></head><body>` + tt.want + `</body></html>`
+
+			doc, err := goquery.NewDocumentFromReader(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = replaceStyleAttrs(doc, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := doc.Html()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			o := string(h)
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+}
+
 func TestReplaceCSSURLs(t *testing.T) {
 	tests := []struct {
 		in, want string
@@ -105,7 +234,13 @@ func TestReplaceCSSURLs(t *testing.T) {
 		{`span { display: block; }`, `span { display: block; }`},
 		{`@import './testdata/a.css';`, "div {\n\tdisplay: none;\n}\n"},
 		{`@import url("./testdata/a.css");`, "div {\n\tdisplay: none;\n}\n"},
-		{`@import url("./testdata/a.css") print;`, "div {\n\tdisplay: none;\n}\n"},
+		{`@import url("./testdata/a.css") print;`, "@media print{div {\n\tdisplay: none;\n}\n}"},
+		{`@import url(./testdata/a.css) all`, "div {\n\tdisplay: none;\n}\n"},
+		{`@import './testdata/a.css' screen and (min-width: 600px), print;`, "@media screen and (min-width: 600px), print{div {\n\tdisplay: none;\n}\n}"},
+		{`@import "./testdata/a.css" layer;`, "@layer{div {\n\tdisplay: none;\n}\n}"},
+		{`@import "./testdata/a.css" layer(base) supports(display:grid);`, "@supports (display:grid){@layer base{div {\n\tdisplay: none;\n}\n}}"},
+		{`@import "./testdata/a.css" supports((display: grid) and (not selector(:has(a)))) print;`, "@media print{@supports (display: grid) and (not selector(:has(a))){div {\n\tdisplay: none;\n}\n}}"},
+		{`@import url("./testdata/a.css") layer(x.y) supports(display: flex) screen;`, "@media screen{@supports (display: flex){@layer x.y{div {\n\tdisplay: none;\n}\n}}}"},
 		{
 			`span { background-image: url('testdata/a.png'); }`,
 			`span { background-image: url(data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAIAAACQd1PeAAAACXBIWXMAAAsTAAALEwEAmpwYAAAAB3RJTUUH4QsYBTofXds9gQAAAAZiS0dEAP8A/wD/oL2nkwAAAAxJREFUCB1jkPvPAAACXAEebXgQcwAAAABJRU5ErkJggg==); }`,
@@ -114,11 +249,15 @@ func TestReplaceCSSURLs(t *testing.T) {
 			`span { background-image: url(data:image/png;base64,iVBORw0KGgoAAA==); }`,
 			`span { background-image: url(data:image/png;base64,iVBORw0KGgoAAA==); }`,
 		},
+		{
+			`span { background-image: url('testdata/nonexistent.png'); }`,
+			`span { background-image: url('testdata/nonexistent.png'); }`,
+		},
 	}
 
 	for i, tt := range tests {
 		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
-			out, err := replaceCSSURLs(Options{Local: CSS | Image}, tt.in)
+			out, err := replaceCSSURLs(Options{Local: CSS | Image, Quiet: true}, &url.URL{Scheme: "file", Path: "/"}, tt.in, newImports(Options{}, nil))
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -128,3 +267,64 @@ func TestReplaceCSSURLs(t *testing.T) {
 		})
 	}
 }
+
+const pngB64 = `iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAIAAACQd1PeAAAACXBIWXMAAAsTAAALEwEAmpwYAAAAB3RJTUUH4QsYBTofXds9gQAAAAZiS0dEAP8A/wD/oL2nkwAAAAxJREFUCB1jkPvPAAACXAEebXgQcwAAAABJRU5ErkJggg==`
+
+func TestReplaceCSSURLsImportChain(t *testing.T) {
+	files := map[string]string{
+		"a.css":    `@import "b.css"; a {}`,
+		"b.css":    `@import "a.css"; b {}`,
+		"self.css": `@import "./self.css"; self {}`,
+		"c.css":    `@import "d.css"; @import "e.css"; @import "d.css"; c {}`,
+		"d.css":    `d {}`,
+		"e.css":    `@import "d.css"; e {}`,
+		"n0.css":   `@import "n1.css"; n0 {}`,
+		"n1.css":   `@import "n2.css"; n1 {}`,
+		"n2.css":   `@import "n3.css"; n2 {}`,
+		"n3.css":   `n3 {}`,
+		"red.css":  `p { color: red }`,
+		"blue.css": `p { color: blue }`,
+		"pr.css":   `@import "red.css" print;`,
+	}
+	fetcher := FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+		return &Resource{Data: []byte(files[path])}, nil
+	})
+
+	tests := []struct {
+		in, want string
+		opts     Options
+		wantErr  string
+	}{
+		{`@import "a.css";`, ` b {} a {}`, Options{Quiet: true}, ""},
+		{`@import "a.css";`, ``, Options{Strict: true}, "circular @import: a.css → b.css → a.css"},
+		{`@import "self.css";`, ``, Options{Strict: true}, "circular @import: self.css → self.css"},
+		{`@import "c.css";`, `  e {} d {} c {}`, Options{Strict: true}, ""},
+		{`@import "c.css"; @import "d.css";`, `  e {}  c {} d {}`, Options{Strict: true}, ""},
+		{`@import "n0.css";`, `n3 {} n2 {} n1 {} n0 {}`, Options{Strict: true}, ""},
+		// Only the last import is kept, so red comes last, like in browsers.
+		{`@import "red.css"; @import "blue.css"; @import "red.css";`, ` p { color: blue } p { color: red }`, Options{Strict: true}, ""},
+		// Imports with different conditions are all kept.
+		{`@import "red.css" print; @import "red.css";`, `@media print{p { color: red }} p { color: red }`, Options{Strict: true}, ""},
+		{`@import "red.css" layer(x); @import "red.css" layer(y);`, `@layer x{p { color: red }} @layer y{p { color: red }}`, Options{Strict: true}, ""},
+		{`@import "pr.css" screen; @import "red.css" print;`, `@media screen{@media print{p { color: red }}} @media print{p { color: red }}`, Options{Strict: true}, ""},
+		{`@import "pr.css"; @import "red.css" print;`, ` @media print{p { color: red }}`, Options{Strict: true}, ""},
+		// The layer is still declared at the first import.
+		{`@import "red.css" layer(x); @import "blue.css" layer(y); @import "red.css" layer(x);`,
+			`@layer x{} @layer y{p { color: blue }} @layer x{p { color: red }}`, Options{Strict: true}, ""},
+		{`@import "n0.css";`, ``, Options{Strict: true, MaxImportDepth: 3},
+			"@import nested more than 3 levels deep: n0.css → n1.css → n2.css → n3.css"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.opts.Local, tt.opts.Fetcher = CSS, fetcher
+			out, err := replaceCSSURLs(tt.opts, &url.URL{Scheme: "file", Path: "/"}, tt.in, newImports(tt.opts, nil))
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nout:  %v\nwant: %v\n", err, tt.wantErr)
+			}
+			if out != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
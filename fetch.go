@@ -0,0 +1,482 @@
+package singlepage
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/zstd/zstring"
+	"zgo.at/zstd/zsync"
+)
+
+// Fetcher retrieves resources.
+//
+// The path is either a local path or a remote http:// or https:// URL; use
+// the path as-is if you want to do anything else (such as mapping remote URLs
+// to an in-memory cache).
+//
+// Errors should be returned as a *LookupError if the resource can't be found,
+// which makes them non-fatal unless Options.Strict is set. The fetch should be
+// aborted if the context is cancelled.
+//
+// MaxSize(ctx) is the maximum size of the resource; if it's larger a Fetcher
+// should return a *LookupError without reading all of it.
+type Fetcher interface {
+	Fetch(ctx context.Context, path string) (*Resource, error)
+}
+
+// FetcherFunc is an adapter to use an ordinary function as a Fetcher.
+type FetcherFunc func(ctx context.Context, path string) (*Resource, error)
+
+// Fetch calls f(ctx, path).
+func (f FetcherFunc) Fetch(ctx context.Context, path string) (*Resource, error) {
+	return f(ctx, path)
+}
+
+type maxSizeKey struct{}
+
+// MaxSize gets the maximum size in bytes of the resource to fetch, or 0 if
+// there is no limit.
+func MaxSize(ctx context.Context) int64 {
+	n, _ := ctx.Value(maxSizeKey{}).(int64)
+	return n
+}
+
+func withMaxSize(ctx context.Context, n int64) context.Context {
+	if n <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, maxSizeKey{}, n)
+}
+
+// Get the error for a resource that's larger than MaxSize(ctx).
+func errTooLarge(path string, n int64) error {
+	return &LookupError{Path: path, Err: fmt.Errorf(
+		"not inlining %s: larger than the maximum size of %d bytes", path, n)}
+}
+
+// Resource is a fetched resource.
+type Resource struct {
+	Data        []byte
+	ContentType string // Content type, may be blank if unknown.
+	URL         string // Final location after any redirects.
+}
+
+// MediaType gets the media type of the resource, without any parameters.
+//
+// This uses the ContentType if set, falling back to guessing it from the
+// extension.
+func (r Resource) MediaType() string {
+	if r.ContentType != "" {
+		m, _, err := mime.ParseMediaType(r.ContentType)
+		if err == nil && m != "application/octet-stream" {
+			return m
+		}
+	}
+	m, _, _ := mime.ParseMediaType(mime.TypeByExtension(path.Ext(stripQuery(r.URL))))
+	return m
+}
+
+// DefaultFetcher reads local paths from the filesystem and remote paths over
+// HTTP.
+type DefaultFetcher struct {
+	// HTTP client to use; if nil a client with a 5 second timeout will be
+	// used.
+	Client *http.Client
+
+	// Directory to cache remote resources in. Cached resources are
+	// revalidated with the ETag and Last-Modified headers. Caching is
+	// disabled if this is blank.
+	CacheDir string
+
+	// Never make any HTTP requests, and serve remote resources only from
+	// CacheDir. Resources that aren't in the cache are reported as a
+	// LookupError.
+	Offline bool
+
+	// Don't print warnings to stderr if CacheDir can't be read from or
+	// written to. Resources are fetched as if they're not cached in that case.
+	Quiet bool
+}
+
+var defaultClient = &http.Client{Timeout: 5 * time.Second}
+
+// Fetch a path.
+func (f *DefaultFetcher) Fetch(ctx context.Context, path string) (*Resource, error) {
+	max := MaxSize(ctx)
+	if !isRemote(path) {
+		if max > 0 {
+			st, err := os.Stat(path)
+			if err == nil && st.Size() > max {
+				return nil, errTooLarge(path, max)
+			}
+		}
+		d, err := os.ReadFile(path)
+		if err != nil {
+			return nil, &LookupError{Path: path, Err: err}
+		}
+		return &Resource{
+			Data:        d,
+			ContentType: mime.TypeByExtension(filepath.Ext(path)),
+			URL:         path,
+		}, nil
+	}
+
+	if strings.HasPrefix(path, "//") {
+		path = "https:" + path
+	}
+
+	var cached *cacheEntry
+	if f.CacheDir != "" {
+		var err error
+		cached, err = readCache(f.CacheDir, path)
+		f.warn(err)
+	}
+	if f.Offline {
+		if cached == nil {
+			return nil, &LookupError{Path: path, Err: errors.New("not in cache (offline mode)")}
+		}
+		return cached.resource(), nil // Size is checked by fetchPath().
+	}
+
+	c := f.Client
+	if c == nil {
+		c = defaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, &LookupError{Path: path, Err: err}
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, &LookupError{Path: path, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.resource(), nil
+	}
+
+	body := io.Reader(resp.Body)
+	if max > 0 && resp.StatusCode == 200 {
+		if resp.ContentLength > max {
+			return nil, errTooLarge(path, max)
+		}
+		body = io.LimitReader(body, max+1)
+	}
+	d, err := io.ReadAll(body)
+	if err != nil {
+		return nil, &LookupError{Path: path, Err: err}
+	}
+	if max > 0 && int64(len(d)) > max {
+		return nil, errTooLarge(path, max)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, &LookupError{
+			Path: path,
+			Err: fmt.Errorf("%d %s: %s", resp.StatusCode, resp.Status,
+				zstring.ElideLeft(string(d), 100)),
+		}
+	}
+
+	r := &Resource{
+		Data:        d,
+		ContentType: resp.Header.Get("Content-Type"),
+		URL:         resp.Request.URL.String(),
+	}
+	if f.CacheDir != "" {
+		err := writeCache(f.CacheDir, path, cacheEntry{
+			URL:          r.URL,
+			ContentType:  r.ContentType,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Data:         d,
+		})
+		f.warn(err)
+	}
+	return r, nil
+}
+
+// Errors from the cache never fail the fetch, since we can always fetch the
+// resource without it.
+func (f *DefaultFetcher) warn(err error) {
+	if err != nil && !f.Quiet {
+		_, _ = fmt.Fprintf(os.Stderr, "singlepage: warning: %s\n", err)
+	}
+}
+
+// FSFetcher reads local paths from a fs.FS.
+//
+// Remote paths are passed on to Remote; if Remote is nil a LookupError is
+// returned for all remote paths.
+type FSFetcher struct {
+	FS     fs.FS
+	Remote Fetcher
+}
+
+// Fetch a path.
+func (f FSFetcher) Fetch(ctx context.Context, p string) (*Resource, error) {
+	if isRemote(p) {
+		if f.Remote == nil {
+			return nil, &LookupError{Path: p, Err: errors.New("remote paths not supported")}
+		}
+		return f.Remote.Fetch(ctx, p)
+	}
+
+	name := strings.TrimLeft(path.Clean("/"+filepath.ToSlash(p)), "/")
+	if name == "" {
+		name = "."
+	}
+	if max := MaxSize(ctx); max > 0 {
+		st, err := fs.Stat(f.FS, name)
+		if err == nil && st.Size() > max {
+			return nil, errTooLarge(p, max)
+		}
+	}
+	d, err := fs.ReadFile(f.FS, name)
+	if err != nil {
+		return nil, &LookupError{Path: p, Err: err}
+	}
+	return &Resource{
+		Data:        d,
+		ContentType: mime.TypeByExtension(path.Ext(name)),
+		URL:         p,
+	}, nil
+}
+
+var defaultFetcher Fetcher = &DefaultFetcher{}
+
+func (opts Options) fetcher() Fetcher {
+	if opts.Fetcher == nil {
+		return defaultFetcher
+	}
+	return opts.Fetcher
+}
+
+// Fetch a resolved URL with the configured Fetcher.
+func (opts Options) fetch(u *url.URL) (*Resource, error) {
+	return opts.fetchMax(u, 0)
+}
+
+// Fetch a resolved URL with the configured Fetcher, returning a LookupError if
+// it's larger than max bytes (if max > 0).
+func (opts Options) fetchMax(u *url.URL, max int64) (*Resource, error) {
+	ctx := opts.context()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	req := fetchRequest{path: opts.fetchPath(u), max: max}
+	if opts.cache == nil {
+		return fetchPath(ctx, opts.fetcher(), req)
+	}
+
+	if r, ok := opts.cache.get(req); ok {
+		return r.res, r.err
+	}
+	if opts.collect != nil {
+		opts.collect.add(req)
+		return nil, &LookupError{Path: req.path, Err: errNotFetched}
+	}
+	return opts.cache.fetch(ctx, opts.fetcher(), req)
+}
+
+// fetchRequest is a path to fetch, with the maximum size in bytes (0 for no
+// limit).
+type fetchRequest struct {
+	path string
+	max  int64
+}
+
+func fetchPath(ctx context.Context, f Fetcher, req fetchRequest) (*Resource, error) {
+	path := req.path
+	r, err := f.Fetch(withMaxSize(ctx, req.max), path)
+	if err != nil {
+		// Return the context error as-is, rather than whatever the Fetcher
+		// wrapped it in, so it's never treated as a non-fatal error.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	// The Fetcher may not support MaxSize.
+	if req.max > 0 && int64(len(r.Data)) > req.max {
+		return nil, errTooLarge(path, req.max)
+	}
+	if r.URL == "" {
+		cp := *r
+		cp.URL = path
+		r = &cp
+	}
+	return r, nil
+}
+
+var errNotFetched = errors.New("not fetched yet")
+
+type (
+	// assetCache stores fetched and processed resources, so that every path
+	// is only fetched and processed once. It's safe for concurrent use.
+	assetCache struct {
+		mu        sync.Mutex
+		fetched   map[fetchRequest]*fetchResult
+		processed map[string]string
+	}
+	fetchResult struct {
+		done chan struct{} // Closed once the fetch is finished.
+		res  *Resource
+		err  error
+	}
+)
+
+func newAssetCache() *assetCache {
+	return &assetCache{
+		fetched:   make(map[fetchRequest]*fetchResult),
+		processed: make(map[string]string),
+	}
+}
+
+// get a fetched resource; this doesn't wait for in-progress fetches.
+func (c *assetCache) get(req fetchRequest) (*fetchResult, bool) {
+	c.mu.Lock()
+	r, ok := c.fetched[req]
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	select {
+	case <-r.done:
+		return r, true
+	default:
+		return nil, false
+	}
+}
+
+// fetch a resource, or wait for the result if it's already being fetched.
+func (c *assetCache) fetch(ctx context.Context, f Fetcher, req fetchRequest) (*Resource, error) {
+	for {
+		c.mu.Lock()
+		r, ok := c.fetched[req]
+		if !ok {
+			r = &fetchResult{done: make(chan struct{})}
+			c.fetched[req] = r
+			c.mu.Unlock()
+
+			r.res, r.err = fetchPath(ctx, f, req)
+			if ctx.Err() != nil { // Don't cache cancelled fetches.
+				c.mu.Lock()
+				delete(c.fetched, req)
+				c.mu.Unlock()
+			}
+			close(r.done)
+			return r.res, r.err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-r.done:
+		}
+		// Fetch was cancelled by someone else's context; try again.
+		if errors.Is(r.err, context.Canceled) || errors.Is(r.err, context.DeadlineExceeded) {
+			continue
+		}
+		return r.res, r.err
+	}
+}
+
+// fetchAll fetches all requests, running at most n fetches concurrently.
+func (c *assetCache) fetchAll(ctx context.Context, f Fetcher, reqs []fetchRequest, n int) {
+	if n < 1 {
+		n = 1
+	}
+	w := zsync.NewAtMost(n)
+	for _, r := range reqs {
+		if ctx.Err() != nil {
+			break
+		}
+		w.Run(func() { c.fetch(ctx, f, r) })
+	}
+	w.Wait()
+}
+
+// process runs f only once for every resource, caching the result.
+//
+// The result is cached by the kind of processing, the resource's URL, and
+// everything that may differ between documents: the input if it's not the
+// resource's data as-is (such as a module with rewritten specifiers), and the
+// chains of SVG images and frames that are being inlined, which affect the
+// result if there are circular references.
+//
+// Nothing is cached if there's no cache or if we're only collecting paths, and
+// errors are never cached.
+func (opts Options) process(kind, url, input string, f func() (string, error)) (string, error) {
+	if opts.cache == nil || opts.collect != nil {
+		return f()
+	}
+
+	h := sha256.Sum256([]byte(input))
+	key := strings.Join([]string{kind, url, string(h[:]),
+		strings.Join(opts.svgChain, " "), strings.Join(opts.frameChain, " ")}, "\x00")
+
+	opts.cache.mu.Lock()
+	p, ok := opts.cache.processed[key]
+	opts.cache.mu.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	p, err := f()
+	if err != nil {
+		return "", err
+	}
+	opts.cache.mu.Lock()
+	opts.cache.processed[key] = p
+	opts.cache.mu.Unlock()
+	return p, nil
+}
+
+// collector records the paths that would be fetched.
+type collector struct {
+	seen map[fetchRequest]struct{}
+	reqs []fetchRequest
+}
+
+func (c *collector) add(req fetchRequest) {
+	if c.seen == nil {
+		c.seen = make(map[fetchRequest]struct{})
+	}
+	if _, ok := c.seen[req]; ok {
+		return
+	}
+	c.seen[req] = struct{}{}
+	c.reqs = append(c.reqs, req)
+}
+
+func stripQuery(path string) string {
+	if i := strings.IndexAny(path, "?#"); i > -1 {
+		return path[:i]
+	}
+	return path
+}
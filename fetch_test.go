@@ -0,0 +1,304 @@
+package singlepage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"zgo.at/zstd/ztest"
+)
+
+func TestDefaultFetcher(t *testing.T) {
+	tests := []struct {
+		in, want, wantType string
+	}{
+		{"./bundle_test.go", "package singlepage", ""},
+		{"./testdata/a.css", "div {", "text/css"},
+		{"//example.com", "<!doctype html>", "text/html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := new(DefaultFetcher).Fetch(context.Background(), tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			o := string(bytes.Split(out.Data, []byte("\n"))[0])
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+			if tt.wantType != "" && out.MediaType() != tt.wantType {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out.MediaType(), tt.wantType)
+			}
+		})
+	}
+}
+
+func TestDefaultFetcherHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/img", http.StatusFound)
+		case "/img":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("PNG"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	out, err := new(DefaultFetcher).Fetch(context.Background(), srv.URL+"/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Data) != "PNG" || out.MediaType() != "image/png" || out.URL != srv.URL+"/img" {
+		t.Errorf("wrong resource: %#v", out)
+	}
+
+	_, err = new(DefaultFetcher).Fetch(context.Background(), srv.URL+"/nonexist")
+	if _, ok := err.(*LookupError); !ok || !ztest.ErrorContains(err, "404") {
+		t.Errorf("wrong error: %#v", err)
+	}
+}
+
+func TestFSFetcher(t *testing.T) {
+	f := FSFetcher{FS: fstest.MapFS{
+		"a.css":     {Data: []byte("div { }")},
+		"img/a.png": {Data: []byte("PNG")},
+	}}
+
+	tests := []struct {
+		in, want, wantType, wantErr string
+	}{
+		{"a.css", "div { }", "text/css", ""},
+		{"./a.css", "div { }", "text/css", ""},
+		{"/img/a.png", "PNG", "image/png", ""},
+		{"img/../a.css", "div { }", "text/css", ""},
+		{"nonexist.css", "", "", "file does not exist"},
+		{"https://example.com/a.css", "", "", "remote paths not supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := f.Fetch(context.Background(), tt.in)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nout:  %v\nwant: %v\n", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				if _, ok := err.(*LookupError); !ok {
+					t.Errorf("not a LookupError: %T", err)
+				}
+				return
+			}
+
+			if string(out.Data) != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", string(out.Data), tt.want)
+			}
+			if out.MediaType() != tt.wantType {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out.MediaType(), tt.wantType)
+			}
+		})
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("PNG"))
+		case "/large":
+			w.Write([]byte("PNGPNGPNG"))
+		case "/chunked": // No Content-Length.
+			w.Write([]byte("PNGPNG"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("PNG"))
+		}
+	}))
+	defer srv.Close()
+
+	fsys := fstest.MapFS{
+		"small.png": {Data: []byte("PNG")},
+		"large.png": {Data: []byte("PNGPNGPNG")},
+	}
+	var (
+		def     = new(DefaultFetcher)
+		fsf     = FSFetcher{FS: fsys}
+		nolimit = FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+			return fsf.Fetch(context.Background(), path)
+		})
+	)
+
+	tests := []struct {
+		f       Fetcher
+		in      string
+		wantErr string
+	}{
+		{def, srv.URL + "/small", ""},
+		{def, srv.URL + "/large", "larger than the maximum size"},
+		{def, srv.URL + "/chunked", "larger than the maximum size"},
+		{def, "./testdata/a.css", "larger than the maximum size"},
+		{fsf, "small.png", ""},
+		{fsf, "large.png", "larger than the maximum size"},
+		{nolimit, "large.png", "larger than the maximum size"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			u, err := url.Parse(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Options{Fetcher: tt.f}.fetchMax(u, 4)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nout:  %v\nwant: %v\n", err, tt.wantErr)
+			}
+			if _, ok := err.(*LookupError); tt.wantErr != "" && !ok {
+				t.Errorf("not a LookupError: %T", err)
+			}
+		})
+	}
+}
+
+func TestFetcher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetched []string
+	)
+	opts := Options{
+		Local:  CSS | JS | Image,
+		Remote: CSS | JS | Image,
+		Fetcher: FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+			mu.Lock()
+			fetched = append(fetched, path)
+			mu.Unlock()
+			switch path {
+			case "a.js":
+				return &Resource{Data: []byte("var a;")}, nil
+			case "https://example.com/a.css":
+				return &Resource{Data: []byte("div{}")}, nil
+			case "https://example.com/img":
+				return &Resource{Data: []byte("x"), ContentType: "image/gif"}, nil
+			}
+			return nil, &LookupError{Path: path, Err: errors.New("not found")}
+		}),
+	}
+
+	out, err := Bundle([]byte(`<html><head>`+
+		`<link rel="stylesheet" href="https://example.com/a.css">`+
+		`<script src="a.js"></script>`+
+		`</head><body><img src="https://example.com/img"></body></html>`), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<html><head><style>div{}</style><script>var a;</script></head>` +
+		`<body><img src="data:image/gif;base64,eA=="/></body></html>`
+	if out != want {
+		t.Errorf("\nout:  %#v\nwant: %#v\n", out, want)
+	}
+	if len(fetched) != 3 {
+		t.Errorf("fetched: %v", fetched)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	var (
+		mu                  sync.Mutex
+		running, max, limit int
+		fetched             = make(map[string]int)
+		reached             chan struct{} // Closed once limit fetches are running.
+	)
+	fetcher := FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+		mu.Lock()
+		fetched[path]++
+		running++
+		if running > max {
+			max = running
+			if max == limit {
+				close(reached)
+			}
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		// Wait until the limit is reached, so we know it's reached at least
+		// once, no matter how slow the scheduling is. There are always more
+		// paths than the limit in the first round.
+		select {
+		case <-reached:
+		case <-time.After(5 * time.Second):
+		}
+		switch {
+		case strings.HasPrefix(path, "i"):
+			return &Resource{Data: []byte(`span { background: url(` + path + `.png); }`)}, nil
+		case strings.HasSuffix(path, ".css"):
+			return &Resource{Data: []byte(`@import "i` + path + `"; div { background: url(bg.png); }`)}, nil
+		case strings.HasSuffix(path, ".js"):
+			return &Resource{Data: []byte(`var a = 1;`)}, nil
+		case strings.Contains(path, "missing"):
+			return nil, &LookupError{Path: path, Err: errors.New("not found")}
+		}
+		return &Resource{Data: []byte(path)}, nil
+	})
+
+	html := new(strings.Builder)
+	html.WriteString("<html><head>")
+	for i := range 5 {
+		fmt.Fprintf(html, `<link rel="stylesheet" href="%d.css"><script src="%d.js"></script>`, i, i)
+	}
+	html.WriteString("</head><body>")
+	for i := range 20 {
+		fmt.Fprintf(html, `<img src="https://example.com/%d.png"><img src="missing%d.png">`, i, i)
+	}
+	html.WriteString("</body></html>")
+
+	bundle := func(n int) string {
+		clear(fetched)
+		max, limit, reached = 0, n, make(chan struct{})
+		out, err := Bundle([]byte(html.String()), Options{
+			Local: CSS | JS | Image, Remote: Image, Minify: CSS | JS,
+			Quiet: true, Parallel: n, Fetcher: fetcher,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for p, n := range fetched {
+			if n != 1 {
+				t.Errorf("%q fetched %d times", p, n)
+			}
+		}
+		return out
+	}
+
+	serial := bundle(1)
+	if max != 1 {
+		t.Errorf("max running for serial: %d", max)
+	}
+	parallel := bundle(4)
+	if max > 4 {
+		t.Errorf("max running for parallel: %d", max)
+	}
+	select {
+	case <-reached:
+	default:
+		t.Errorf("never ran 4 fetches in parallel; max running: %d", max)
+	}
+	if serial != parallel {
+		t.Errorf("output differs\nserial:   %s\nparallel: %s", serial, parallel)
+	}
+}
@@ -0,0 +1,122 @@
+package singlepage
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Replace <iframe src=".."> with <iframe srcdoc="..">, bundling the framed
+// document with the same options.
+//
+// References in the framed document are resolved relative to its location, but
+// note that the base URL of a srcdoc document is that of the parent document,
+// so links that aren't bundled may point to a different location.
+//
+// A srcdoc document also has the parent document's origin, giving it access to
+// the parent's DOM, cookies, and storage. Frames from a different origin are
+// therefore only bundled if the <iframe> has a sandbox attribute without
+// allow-same-origin, which gives it a unique origin.
+func replaceFrames(doc *goquery.Document, opts Options) (err error) {
+	if !opts.Local.Has(Frame) && !opts.Remote.Has(Frame) {
+		return nil
+	}
+
+	base, err := opts.baseURL()
+	if err != nil {
+		return err
+	}
+
+	doc.Find(`iframe[src]`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		// srcdoc takes precedence over src.
+		if _, ok := s.Attr("srcdoc"); ok {
+			return true
+		}
+		sandbox, ok := s.Attr("sandbox")
+		sandboxed := ok && !slices.Contains(strings.Fields(strings.ToLower(sandbox)), "allow-same-origin")
+
+		var h string
+		h, err = bundleFrame(opts, base, s.AttrOr("src", ""), sandboxed)
+		if err != nil {
+			return false
+		}
+		if h != "" {
+			// Replace src in-place, to keep the attribute order.
+			for j, a := range s.Nodes[0].Attr {
+				if a.Namespace == "" && a.Key == "src" {
+					s.Nodes[0].Attr[j].Key, s.Nodes[0].Attr[j].Val = "srcdoc", h
+				}
+			}
+		}
+		return true
+	})
+	return err
+}
+
+// Get the bundled HTML for the framed document ref.
+//
+// This returns "" if it's not inlined because of the Local and Remote options,
+// if it's from a different origin than base and not sandboxed, if it's not a
+// HTML document, or if there was a non-fatal error.
+func bundleFrame(opts Options, base *url.URL, ref string, sandboxed bool) (string, error) {
+	u, err := resolve(base, ref)
+	cont, err := warn(opts, err)
+	if err != nil || !cont || u == nil {
+		return "", err
+	}
+
+	if isRemoteURL(u) && !opts.Remote.Has(Frame) {
+		return "", nil
+	}
+	if !isRemoteURL(u) && !opts.Local.Has(Frame) {
+		return "", nil
+	}
+	if !sandboxed && origin(u) != origin(base) {
+		return "", nil
+	}
+
+	p := opts.fetchPath(u)
+	if slices.Contains(opts.frameChain, p) {
+		_, err := warn(opts, &ParseError{Path: p, Err: fmt.Errorf("circular frame: %s",
+			strings.Join(append(opts.frameChain, p), " → "))})
+		return "", err
+	}
+	if len(opts.frameChain) >= opts.maxFrameDepth() {
+		_, err := warn(opts, &ParseError{Path: p, Err: fmt.Errorf("frames nested more than %d levels deep: %s",
+			opts.maxFrameDepth(), strings.Join(append(opts.frameChain, p), " → "))})
+		return "", err
+	}
+
+	res, err := opts.fetch(u)
+	cont, err = warn(opts, err)
+	if err != nil || !cont {
+		return "", err
+	}
+	if m := res.MediaType(); m != "" && m != "text/html" && m != "application/xhtml+xml" {
+		return "", nil
+	}
+	if !sandboxed && origin(resourceURL(u, res)) != origin(base) { // Redirected.
+		return "", nil
+	}
+
+	return opts.process("frame", res.URL, "", func() (string, error) {
+		frame := opts
+		frame.base = resourceURL(u, res)
+		frame.frameChain = append(slices.Clip(opts.frameChain), p)
+		h, err := bundle(res.Data, frame)
+		if err != nil {
+			return "", fmt.Errorf("could not bundle %v: %w", res.URL, err)
+		}
+		return h, nil
+	})
+}
+
+func (opts Options) maxFrameDepth() int {
+	if opts.MaxFrameDepth < 1 {
+		return 4
+	}
+	return opts.MaxFrameDepth
+}
@@ -0,0 +1,102 @@
+package singlepage
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io/fs"
+	"testing"
+
+	"zgo.at/zstd/ztest"
+)
+
+func TestReplaceFrames(t *testing.T) {
+	doc := func(body string) string { return `<html><head></head><body>` + body + `</body></html>` }
+	a := doc(`<p class="x">A &amp; <img src="data:image/png;base64,UE5H"/></p>`)
+
+	remote := FetcherFunc(func(ctx context.Context, path string) (*Resource, error) {
+		switch path {
+		case "https://example.com/a.html":
+			return &Resource{Data: []byte(`<p>A</p>`), ContentType: "text/html"}, nil
+		case "https://example.com/redirect.html":
+			return &Resource{Data: []byte(`<p>A</p>`), ContentType: "text/html", URL: "https://example.net/a.html"}, nil
+		}
+		return nil, &LookupError{Path: path, Err: fs.ErrNotExist}
+	})
+	remoteA := html.EscapeString(doc(`<p>A</p>`))
+
+	tests := []struct {
+		in, want string
+		opts     Options
+	}{
+		{
+			`<iframe src="demo/a.html" width="300"></iframe>`,
+			`<iframe srcdoc="` + html.EscapeString(a) + `" width="300"></iframe>`,
+			Options{Local: Frame | Image},
+		},
+		{ // Nested.
+			`<iframe src="demo/b.html"></iframe>`,
+			`<iframe srcdoc="` + html.EscapeString(doc(`<iframe srcdoc="`+html.EscapeString(a)+`"></iframe>`)) + `"></iframe>`,
+			Options{Local: Frame | Image},
+		},
+		{ // Circular; the innermost frame is left as-is.
+			`<iframe src="loop/a.html"></iframe>`,
+			`<iframe srcdoc="` + html.EscapeString(doc(`<iframe srcdoc="`+html.EscapeString(doc(`<iframe src="a.html"></iframe>`))+`"></iframe>`)) + `"></iframe>`,
+			Options{Local: Frame, Quiet: true},
+		},
+		{ // Depth limit.
+			`<iframe src="demo/b.html"></iframe>`,
+			`<iframe srcdoc="` + html.EscapeString(doc(`<iframe src="a.html"></iframe>`)) + `"></iframe>`,
+			Options{Local: Frame, Quiet: true, MaxFrameDepth: 1},
+		},
+		{ // Not HTML, has srcdoc, not enabled, not found.
+			`<iframe src="demo/data.pdf"></iframe><iframe src="demo/a.html" srcdoc="x"></iframe><iframe src="x.html"></iframe>`,
+			`<iframe src="demo/data.pdf"></iframe><iframe src="demo/a.html" srcdoc="x"></iframe><iframe src="x.html"></iframe>`,
+			Options{Local: Frame, Quiet: true},
+		},
+		{
+			`<iframe src="demo/a.html"></iframe>`,
+			`<iframe src="demo/a.html"></iframe>`,
+			Options{Local: Image, Remote: Frame},
+		},
+		{ // Different origin; only bundled if sandboxed.
+			`<iframe src="https://example.com/a.html"></iframe>` +
+				`<iframe src="https://example.com/a.html" sandbox="allow-scripts allow-same-origin"></iframe>` +
+				`<iframe src="https://example.com/a.html" sandbox=""></iframe>`,
+			`<iframe src="https://example.com/a.html"></iframe>` +
+				`<iframe src="https://example.com/a.html" sandbox="allow-scripts allow-same-origin"></iframe>` +
+				`<iframe srcdoc="` + remoteA + `" sandbox=""></iframe>`,
+			Options{Remote: Frame, Fetcher: remote},
+		},
+		{ // Same origin.
+			`<iframe src="a.html"></iframe><iframe src="https://example.com/a.html"></iframe><iframe src="redirect.html"></iframe>`,
+			`<iframe srcdoc="` + remoteA + `"></iframe><iframe srcdoc="` + remoteA + `"></iframe><iframe src="redirect.html"></iframe>`,
+			Options{Root: "https://example.com/", Remote: Frame, Fetcher: remote},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.in, tt.want = doc(tt.in), doc(tt.want)
+			if tt.opts.Root == "" {
+				tt.opts.Root = "./testdata/frame"
+			}
+
+			o, err := Bundle([]byte(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		_, err := Bundle([]byte(`<iframe src="loop/a.html"></iframe>`),
+			Options{Root: "./testdata/frame", Local: Frame, Strict: true})
+		if !ztest.ErrorContains(err, "circular frame: testdata/frame/loop/a.html → testdata/frame/loop/b.html → testdata/frame/loop/a.html") {
+			t.Fatal(err)
+		}
+	})
+}
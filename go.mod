@@ -6,11 +6,9 @@ require (
 	github.com/PuerkitoBio/goquery v1.10.3
 	github.com/tdewolff/minify/v2 v2.23.8
 	github.com/tdewolff/parse/v2 v2.8.1
+	golang.org/x/net v0.41.0
 	zgo.at/zli v0.0.0-20250614004402-078b5fce471c
 	zgo.at/zstd v0.0.0-20250313035723-1ece53b5d53e
 )
 
-require (
-	github.com/andybalholm/cascadia v1.3.3 // indirect
-	golang.org/x/net v0.41.0 // indirect
-)
+require github.com/andybalholm/cascadia v1.3.3 // indirect
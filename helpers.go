@@ -1,14 +1,18 @@
 package singlepage
 
 import (
+	"bytes"
 	"fmt"
+	"html"
 	"io"
-	"net/http"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
-	"time"
 
-	"zgo.at/zstd/zstring"
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+	xhtml "golang.org/x/net/html"
 )
 
 // LookupError is used when we can't look up a resource. This may be a non-fatal
@@ -58,51 +62,149 @@ func warn(opts Options, err error) (bool, error) {
 
 }
 
-// Read a path, which may be either local or HTTP.
-func readPath(path string) ([]byte, error) {
-	if !isRemote(path) {
-		if strings.HasPrefix(path, "/") {
-			path = "." + path
+// Format HTML attributes, except those in skip.
+//
+// The result is either empty or starts with a space, so it can be used as
+// "<tag" + formatAttr(..) + ">".
+func formatAttr(attrs []xhtml.Attribute, skip ...string) string {
+	var b strings.Builder
+	for _, a := range attrs {
+		if slices.Contains(skip, a.Key) {
+			continue
 		}
-		d, err := os.ReadFile(path)
-		if err != nil {
-			return nil, &LookupError{
-				Path: path,
-				Err:  err,
-			}
+		b.WriteByte(' ')
+		if a.Namespace != "" {
+			b.WriteString(a.Namespace + ":")
+		}
+		b.WriteString(a.Key)
+		if a.Val != "" {
+			b.WriteString(`="` + html.EscapeString(a.Val) + `"`)
 		}
-		return d, nil
 	}
+	return b.String()
+}
 
-	if strings.HasPrefix(path, "//") {
-		path = "https:" + path
+// Report if the space-separated list in s contains tok, ignoring case.
+func hasToken(s, tok string) bool {
+	return slices.ContainsFunc(strings.Fields(s), func(f string) bool {
+		return strings.EqualFold(f, tok)
+	})
+}
+
+var (
+	reEndScript = regexp.MustCompile(`(?i)</(script)`)
+	reEndStyle  = regexp.MustCompile(`(?i)</(style)`)
+	reComment   = regexp.MustCompile(`<!--`)
+)
+
+// Escape the contents of a <script> element, so that "</script" or "<!--" in
+// strings or comments can't end the element early or start a comment.
+//
+// JSON uses \u003c. JavaScript uses "<\/script", which is the same in strings,
+// templates, regular expressions, and comments. "<!--" is "\x3C!--" in
+// strings, templates, and regular expressions, as "\!" isn't valid in regular
+// expressions with the u flag, and "<\!--" in comments. Other types are left
+// alone, as they can't be escaped without changing their content.
+func escapeScript(typ, s string) string {
+	switch {
+	case isJSONType(typ):
+		s = reEndScript.ReplaceAllString(s, `\u003c/$1`)
+		return reComment.ReplaceAllString(s, `\u003c!--`)
+	case isJSType(typ):
+		return escapeJS(s)
+	default:
+		return s
 	}
+}
 
-	c := http.Client{Timeout: 5 * time.Second}
-	resp, err := c.Get(path)
-	if err != nil {
-		return nil, &LookupError{
-			Path: path,
-			Err:  err,
-		}
+// Escape "</script" and "<!--" in the JavaScript s.
+//
+// Like moduleSpecifiers(), this doesn't parse the full JavaScript and guesses
+// if a "/" is a regular expression from the previous token.
+func escapeJS(s string) string {
+	if !reEndScript.MatchString(s) && !reComment.MatchString(s) {
+		return s
 	}
-	defer resp.Body.Close()
 
-	d, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, &LookupError{
-			Path: path,
-			Err:  err,
+	var (
+		l    = js.NewLexer(parse.NewInputString(s))
+		b    strings.Builder
+		prev js.TokenType // Previous token that's not whitespace or a comment.
+	)
+	b.Grow(len(s))
+	for {
+		tt, text := l.Next()
+		switch tt {
+		case js.ErrorToken:
+			if l.Err() != io.EOF {
+				return escapeComment(s)
+			}
+			return b.String()
+		case js.WhitespaceToken, js.LineTerminatorToken:
+			b.Write(text)
+			continue
+		case js.CommentToken, js.CommentLineTerminatorToken:
+			// HTML-like comment, which is the same as "//".
+			if bytes.HasPrefix(text, []byte("<!--")) {
+				text = append([]byte("//"), text[4:]...)
+			}
+			b.WriteString(escapeComment(string(text)))
+			continue
+		case js.DivToken, js.DivEqToken:
+			if !endsExpression(prev) {
+				tt, text = l.RegExp()
+				if tt == js.ErrorToken {
+					return escapeComment(s)
+				}
+			}
+		}
+
+		// "a</script/i" is the same as "a < /script/i".
+		if prev == js.LtToken && strings.HasSuffix(b.String(), "<") &&
+			len(text) >= 7 && strings.EqualFold(string(text[:7]), "/script") {
+			b.WriteByte(' ')
+		}
+		switch tt {
+		case js.StringToken, js.TemplateToken, js.TemplateStartToken, js.TemplateMiddleToken,
+			js.TemplateEndToken, js.RegExpToken:
+			b.WriteString(escapeLiteral(string(text)))
+		default:
+			b.Write(text)
 		}
+		prev = tt
 	}
+}
+
+// Escape "</script" and "<!--" in a comment (or something that we can't parse
+// as JavaScript).
+func escapeComment(s string) string {
+	s = reEndScript.ReplaceAllString(s, `<\/$1`)
+	return reComment.ReplaceAllString(s, `<\!--`)
+}
 
-	if resp.StatusCode != 200 {
-		return nil, &LookupError{
-			Path: path,
-			Err: fmt.Errorf("%d %s: %s", resp.StatusCode, resp.Status,
-				zstring.ElideLeft(string(d), 100)),
+// Escape "</script" and "<!--" in a string, template, or regular expression
+// literal as "<\/script" and "\x3C!--".
+func escapeLiteral(s string) string {
+	s = reEndScript.ReplaceAllString(s, `<\/$1`)
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "<!--")
+		if i == -1 {
+			b.WriteString(s)
+			return b.String()
 		}
+		pre := s[:i]
+		// "\<" is the same as "<", so remove the backslash.
+		if n := len(pre) - len(strings.TrimRight(pre, `\`)); n%2 == 1 {
+			pre = pre[:len(pre)-1]
+		}
+		b.WriteString(pre + `\x3C`)
+		s = s[i+1:]
 	}
+}
 
-	return d, nil
+// Escape the contents of a <style> element, so that "</style" in strings or
+// comments can't end the element early.
+func escapeStyle(s string) string {
+	return reEndStyle.ReplaceAllString(s, `<\/$1`)
 }
@@ -1,6 +1,8 @@
 package singlepage
 
-import "testing"
+import (
+	"testing"
+)
 
 func TestIsRemote(t *testing.T) {
 	tests := []struct {
@@ -22,3 +24,51 @@ func TestIsRemote(t *testing.T) {
 		})
 	}
 }
+
+func TestEscapeScript(t *testing.T) {
+	tests := []struct {
+		typ, in, want string
+	}{
+		{"", `var x = 1;`, `var x = 1;`},
+		{"", `var x = "</script>";`, `var x = "<\/script>";`},
+		{"module", `x = "</SCRIPT >" + "</scripts"`, `x = "<\/SCRIPT >" + "<\/scripts"`},
+		{"", `// <!-- <script>`, `// <\!-- <script>`},
+		{"", `x = '<!--' + '\<!--'`, `x = '\x3C!--' + '\x3C!--'`},
+		{"", "x = `<!--${a}</script>`", "x = `\\x3C!--${a}<\\/script>`"},
+		{"module", `/<!--|<\/script/u.test(x)`, `/\x3C!--|<\/script/u.test(x)`},
+		{"", `x</script/i.test(y)`, `x< /script/i.test(y)`},
+		{"", "<!-- x\nvar x", "// x\nvar x"},
+		{"text/template", `</script><!--`, `</script><!--`},
+		{"application/ld+json", `{"a": "</script><!--"}`, `{"a": "\u003c/script>\u003c!--"}`},
+		{"importmap", `{"a": "</Script>"}`, `{"a": "\u003c/Script>"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out := escapeScript(tt.typ, tt.in)
+			if out != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapeStyle(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`div { }`, `div { }`},
+		{`/* </style> */`, `/* <\/style> */`},
+		{`div { content: "</STYLE" }`, `div { content: "<\/STYLE" }`},
+		{`div { content: "</styles" }`, `div { content: "<\/styles" }`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out := escapeStyle(tt.in)
+			if out != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package singlepage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// cacheEntry is a cached HTTP response, stored as JSON in the cache directory.
+type cacheEntry struct {
+	URL          string `json:"url"` // Final URL, after redirects.
+	ContentType  string `json:"content_type,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Data         []byte `json:"data"`
+}
+
+func (e cacheEntry) resource() *Resource {
+	return &Resource{Data: e.Data, ContentType: e.ContentType, URL: e.URL}
+}
+
+// Get the cache file for an URL.
+func cacheFile(dir, url string) string {
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".json")
+}
+
+// Read an URL from the cache, returning nil if it's not cached.
+func readCache(dir, url string) (*cacheEntry, error) {
+	d, err := os.ReadFile(cacheFile(dir, url))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading cache: %w", err)
+	}
+
+	var e cacheEntry
+	if err := json.Unmarshal(d, &e); err != nil {
+		// Treat broken entries as not cached; they'll be overwritten.
+		return nil, nil
+	}
+	return &e, nil
+}
+
+// Write an URL to the cache.
+func writeCache(dir, url string, e cacheEntry) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("writing cache: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("writing cache: %w", err)
+	}
+
+	// Write to a temporary file first, so that concurrent readers never see a
+	// partially written file.
+	fp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("writing cache: %w", err)
+	}
+	_, err = fp.Write(d)
+	if cErr := fp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), cacheFile(dir, url))
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return fmt.Errorf("writing cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package singlepage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zgo.at/zstd/ztest"
+)
+
+func TestHTTPCache(t *testing.T) {
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/etag.css":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Type", "text/css")
+			w.Write([]byte("div { }"))
+		case "/modified.png":
+			if r.Header.Get("If-Modified-Since") == "Mon, 02 Jan 2006 15:04:05 GMT" {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("PNG"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	var (
+		ctx     = context.Background()
+		dir     = t.TempDir()
+		online  = &DefaultFetcher{CacheDir: dir}
+		offline = &DefaultFetcher{CacheDir: dir, Offline: true}
+	)
+	for _, tt := range []struct{ path, want, wantType string }{
+		{"/etag.css", "div { }", "text/css"},
+		{"/modified.png", "PNG", "image/png"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			requests, notModified = 0, 0
+
+			_, err := offline.Fetch(ctx, srv.URL+tt.path)
+			if !ztest.ErrorContains(err, "not in cache") {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if _, ok := err.(*LookupError); !ok {
+				t.Fatalf("not a LookupError: %T", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				out, err := online.Fetch(ctx, srv.URL+tt.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(out.Data) != tt.want || out.MediaType() != tt.wantType {
+					t.Errorf("wrong resource: %#v", out)
+				}
+			}
+			if requests != 2 || notModified != 1 {
+				t.Errorf("requests: %d; notModified: %d", requests, notModified)
+			}
+
+			out, err := offline.Fetch(ctx, srv.URL+tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out.Data) != tt.want || out.MediaType() != tt.wantType || out.URL != srv.URL+tt.path {
+				t.Errorf("wrong resource: %#v", out)
+			}
+			if requests != 2 {
+				t.Errorf("offline made a request")
+			}
+		})
+	}
+}
+
+func TestHTTPCacheWriteError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("div { }"))
+	}))
+	defer srv.Close()
+
+	// Cache directory is a file, so writing to it fails.
+	dir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(dir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := (&DefaultFetcher{CacheDir: dir, Quiet: true}).Fetch(context.Background(), srv.URL+"/a.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Data) != "div { }" {
+		t.Errorf("wrong resource: %#v", out)
+	}
+}
@@ -0,0 +1,171 @@
+package singlepage
+
+import (
+	"encoding/json"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// importMap is a parsed <script type="importmap">.
+//
+// https://html.spec.whatwg.org/multipage/webappapis.html#import-maps
+type importMap struct {
+	s       *goquery.Selection
+	base    *url.URL
+	raw     map[string]any               // Original JSON.
+	imports map[string]string            // Normalized specifier → absolute URL.
+	scopes  map[string]map[string]string // Absolute scope URL → imports.
+}
+
+// parseImportMap parses the first inline import map in the document.
+//
+// This always returns an importMap, which is empty if the document has no
+// import map or if it can't be parsed.
+func parseImportMap(doc *goquery.Document, opts Options, base *url.URL) (*importMap, error) {
+	im := &importMap{
+		base:    base,
+		raw:     make(map[string]any),
+		imports: make(map[string]string),
+		scopes:  make(map[string]map[string]string),
+	}
+	doc.Find(`script`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if _, ok := s.Attr("src"); !ok && scriptType(s) == "importmap" {
+			im.s = s
+			return false
+		}
+		return true
+	})
+	if im.s == nil {
+		return im, nil
+	}
+
+	err := json.Unmarshal([]byte(im.s.Text()), &im.raw)
+	if err != nil {
+		_, err = warn(opts, &ParseError{Path: "importmap", Err: err})
+		im.s, im.raw = nil, make(map[string]any)
+		return im, err
+	}
+
+	im.imports = normalizeImports(base, im.raw["imports"])
+	if scopes, ok := im.raw["scopes"].(map[string]any); ok {
+		for k, v := range scopes {
+			u, err := resolve(base, k)
+			if err != nil || u == nil {
+				continue
+			}
+			im.scopes[u.String()] = normalizeImports(base, v)
+		}
+	}
+	return im, nil
+}
+
+// Normalize the keys and addresses in an "imports" object; invalid entries are
+// skipped, as browsers do.
+func normalizeImports(base *url.URL, imports any) map[string]string {
+	n := make(map[string]string)
+	m, _ := imports.(map[string]any)
+	for k, v := range m {
+		addr, ok := v.(string)
+		if !ok {
+			continue
+		}
+		u, err := resolve(base, addr)
+		if err != nil || u == nil {
+			continue
+		}
+		if k = normalizeSpecifier(base, k); k != "" {
+			n[k] = u.String()
+		}
+	}
+	return n
+}
+
+// Normalize a specifier key; URL-like specifiers are resolved to an absolute
+// URL, and bare specifiers are used as-is.
+func normalizeSpecifier(base *url.URL, spec string) string {
+	if !isURLSpecifier(spec) {
+		return spec
+	}
+	u, err := resolve(base, spec)
+	if err != nil || u == nil {
+		return ""
+	}
+	return u.String()
+}
+
+// resolve a module specifier imported from referrer.
+//
+// This returns nil if the specifier can't be resolved, such as bare specifiers
+// that aren't in the import map. bare is set if the specifier is a bare
+// specifier that's mapped in the top-level "imports".
+func (im *importMap) resolve(referrer *url.URL, spec string) (u *url.URL, bare bool, err error) {
+	norm := normalizeSpecifier(referrer, spec)
+	if norm == "" {
+		return nil, false, nil
+	}
+
+	scopes := make([]string, 0, len(im.scopes))
+	for s := range im.scopes {
+		scopes = append(scopes, s)
+	}
+	sort.Slice(scopes, func(i, j int) bool { return len(scopes[i]) > len(scopes[j]) })
+	ref := referrer.String()
+	for _, s := range scopes {
+		if ref == s || (strings.HasSuffix(s, "/") && strings.HasPrefix(ref, s)) {
+			if addr, ok := matchImports(im.scopes[s], norm); ok {
+				u, err := url.Parse(addr)
+				return u, false, err
+			}
+		}
+	}
+
+	if addr, ok := matchImports(im.imports, norm); ok {
+		u, err := url.Parse(addr)
+		_, exact := im.imports[norm]
+		return u, exact && !isURLSpecifier(spec), err
+	}
+	if !isURLSpecifier(spec) {
+		return nil, false, nil
+	}
+	u, err = url.Parse(norm)
+	return u, false, err
+}
+
+// Find a specifier in imports, either as an exact match or with the longest
+// matching prefix that ends with a "/".
+func matchImports(imports map[string]string, spec string) (string, bool) {
+	if addr, ok := imports[spec]; ok {
+		return addr, true
+	}
+	var match string
+	for k := range imports {
+		if strings.HasSuffix(k, "/") && strings.HasPrefix(spec, k) && len(k) > len(match) {
+			match = k
+		}
+	}
+	if match == "" {
+		return "", false
+	}
+	return imports[match] + spec[len(match):], true
+}
+
+// Get all modules in the top-level "imports" which aren't a prefix, sorted by
+// specifier.
+func (im *importMap) modules() []string {
+	var addrs []string
+	keys := make([]string, 0, len(im.imports))
+	for k := range im.imports {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if !strings.HasSuffix(k, "/") {
+			addrs = append(addrs, im.imports[k])
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,125 @@
+package singlepage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func TestImportMapResolve(t *testing.T) {
+	m := `{
+		"imports": {
+			"lit":      "/vendor/lit.js",
+			"lit/":     "/vendor/lit/",
+			"app/":     "./js/",
+			"/js/a.js": "/js/b.js",
+			"cdn":      "https://example.com/cdn.js",
+			"invalid":  1
+		},
+		"scopes": {
+			"/js/old/": {"lit": "/vendor/lit-2.js"}
+		}
+	}`
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(
+		`<script type="importmap">` + m + `</script>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &url.URL{Scheme: "file", Path: "/"}
+	im, err := parseImportMap(doc, Options{}, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		referrer, spec string
+		want           string
+		wantBare       bool
+	}{
+		{"file:///index.html", "lit", "file:///vendor/lit.js", true},
+		{"file:///index.html", "lit/dir.js", "file:///vendor/lit/dir.js", false},
+		{"file:///index.html", "app/x.js", "file:///js/x.js", false},
+		{"file:///index.html", "./js/a.js", "file:///js/b.js", false},
+		{"file:///js/x.js", "./a.js", "file:///js/b.js", false},
+		{"file:///js/x.js", "./c.js", "file:///js/c.js", false},
+		{"file:///index.html", "cdn", "https://example.com/cdn.js", true},
+		{"file:///js/old/x.js", "lit", "file:///vendor/lit-2.js", false},
+		{"file:///js/old/x.js", "lit/dir.js", "file:///vendor/lit/dir.js", false},
+		{"file:///index.html", "unknown", "<nil>", false},
+		{"file:///index.html", "invalid", "<nil>", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.referrer+" "+tt.spec, func(t *testing.T) {
+			ref, _ := url.Parse(tt.referrer)
+			u, bare, err := im.resolve(ref, tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := "<nil>"
+			if u != nil {
+				out = u.String()
+			}
+			if out != tt.want || bare != tt.wantBare {
+				t.Errorf("\nout:  %#v %t\nwant: %#v %t\n", out, bare, tt.want, tt.wantBare)
+			}
+		})
+	}
+}
+
+func TestImportMap(t *testing.T) {
+	lit := `data:text/javascript;base64,` + base64.StdEncoding.EncodeToString([]byte(`export * from "file:///vendor/lit/dir.js"`))
+	dir := `data:text/javascript;base64,` + base64.StdEncoding.EncodeToString([]byte(`export const d = 1`))
+	dyn := `data:text/javascript;base64,` + base64.StdEncoding.EncodeToString([]byte(`export const x = 1`))
+
+	opts := Options{Root: "./testdata/importmap", Local: JS, Quiet: true}
+	tests := []struct {
+		in, want string
+		opts     Options
+	}{
+		{
+			`<script type="importmap">{"imports": {"lit": "/vendor/lit.js", "lit/": "/vendor/lit/", "dyn": "./vendor/dyn.js"}}</script>` +
+				`<script type="module" src="js/app.js"></script>`,
+			`<script type="importmap">{"imports":{` +
+				`"dyn":"` + dyn + `",` +
+				`"file:///vendor/lit/dir.js":"` + dir + `",` +
+				`"lit":"` + lit + `",` +
+				`"lit/":"/vendor/lit/"}}</script>` +
+				`<script type="module">import "lit"; import "file:///vendor/lit/dir.js"</script>`,
+			opts,
+		},
+		{ // Not found: keep as-is.
+			`<script type="importmap">{"imports": {"x": "/nonexistent.js"}}</script>` +
+				`<script type="module">import "x"</script>`,
+			`<script type="importmap">{"imports": {"x": "/nonexistent.js"}}</script>` +
+				`<script type="module">import "x"</script>`,
+			opts,
+		},
+		{ // Invalid JSON
+			`<script type="importmap">{"imports": </script>` +
+				`<script type="module">import "x"</script>`,
+			`<script type="importmap">{"imports": </script>` +
+				`<script type="module">import "x"</script>`,
+			opts,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.in = `<html><head></head><body>` + tt.in + `</body></html>`
+			tt.want = `<html><head></head><body>` + tt.want + `</body></html>`
+
+			o, err := Bundle([]byte(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+}
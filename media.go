@@ -0,0 +1,38 @@
+package singlepage
+
+import (
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Replace the poster and src of <video> and <audio>, <source> elements for
+// them, and <track> subtitles with data: URIs.
+func replaceMedia(doc *goquery.Document, opts Options) (err error) {
+	if !opts.Local.Has(Media) && !opts.Remote.Has(Media) {
+		return nil
+	}
+
+	base, err := opts.baseURL()
+	if err != nil {
+		return err
+	}
+
+	sel := `video[poster], video[src], audio[src], video > source[src], audio > source[src], track[src]`
+	doc.Find(sel).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		for _, attr := range []string{"poster", "src"} {
+			ref, ok := s.Attr(attr)
+			if !ok {
+				continue
+			}
+			var data string
+			data, err = inlineData(opts, base, ref, Media, opts.MaxMediaSize)
+			if err != nil {
+				return false
+			}
+			if data != "" {
+				s.SetAttr(attr, data)
+			}
+		}
+		return true
+	})
+	return err
+}
@@ -0,0 +1,69 @@
+package singlepage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReplaceMedia(t *testing.T) {
+	webm := `data:video/webm;base64,V0VCTQ==`
+	mp3 := `data:audio/mpeg;base64,TVAz`
+
+	tests := []struct {
+		in, want string
+		opts     Options
+	}{
+		{
+			`<video src="v.webm" poster="p.png"><track src="en.vtt" kind="subtitles"/></video>`,
+			`<video src="` + webm + `" poster="data:image/png;base64,UE5H">` +
+				`<track src="data:text/vtt;base64,V0VCVlRU" kind="subtitles"/></video>`,
+			Options{Local: Media},
+		},
+		{
+			`<video><source src="v.webm" type="video/webm"/></video><audio><source src="a.mp3"/></audio><audio src="a.mp3"></audio>`,
+			`<video><source src="` + webm + `" type="video/webm"/></video>` +
+				`<audio><source src="` + mp3 + `"/></audio>` +
+				`<audio src="` + mp3 + `"></audio>`,
+			Options{Local: Media},
+		},
+		{ // Size limit.
+			`<video src="big.webm"></video><video src="v.webm"></video>`,
+			`<video src="big.webm"></video><video src="` + webm + `"></video>`,
+			Options{Local: Media, MaxMediaSize: 4, Quiet: true},
+		},
+		{ // Not enabled.
+			`<video src="v.webm"></video><video><source src="v.webm"/></video>`,
+			`<video src="v.webm"></video><video><source src="v.webm"/></video>`,
+			Options{Local: Image | CSS | JS},
+		},
+		{ // Not found.
+			`<video src="x.webm"></video>`,
+			`<video src="x.webm"></video>`,
+			Options{Local: Media, Quiet: true},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.in = `<html><head></head><body>` + tt.in + `</body></html>`
+			tt.want = `<html><head></head><body>` + tt.want + `</body></html>`
+			tt.opts.Root = "./testdata/media"
+
+			o, err := Bundle([]byte(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		_, err := Bundle([]byte(`<video src="big.webm"></video>`),
+			Options{Root: "./testdata/media", Local: Media, MaxMediaSize: 4, Strict: true})
+		if err == nil {
+			t.Fatal("err is nil")
+		}
+	})
+}
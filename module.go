@@ -0,0 +1,374 @@
+package singlepage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+)
+
+// ES modules are bundled with an import map: every module in the graph is
+// added to the map as a data: URL, keyed by its absolute URL. The import and
+// export specifiers that refer to these modules are rewritten to the absolute
+// URL, which is then looked up in the import map.
+//
+// This keeps every module in its own scope and correctly deals with circular
+// imports, which wouldn't be the case if we concatenated the modules. Note that
+// import.meta.url will be the data: URL.
+//
+// Specifiers are resolved with the document's import map, if any. Bare
+// specifiers such as "lit" are kept as-is if they're mapped in the top-level
+// "imports", and the mapped address is replaced with the data: URL. Everything
+// else is rewritten to the absolute URL, since scopes won't work once the
+// module is a data: URL.
+
+// modules keeps track of the ES modules inlined in a document.
+type modules struct {
+	opts Options
+	imap *importMap
+	urls map[string]string   // Module URL → data: URL; "" while it's processed.
+	refs map[string]struct{} // Module URLs that are used as a specifier.
+}
+
+func newModules(doc *goquery.Document, opts Options, base *url.URL) (*modules, error) {
+	imap, err := parseImportMap(doc, opts, base)
+	if err != nil {
+		return nil, err
+	}
+	return &modules{
+		opts: opts,
+		imap: imap,
+		urls: make(map[string]string),
+		refs: make(map[string]struct{}),
+	}, nil
+}
+
+// Rewrite the import and export specifiers in the module src, inlining all
+// modules they refer to.
+//
+// References are resolved relative to base, which should be the location of
+// the module (or the document for inline scripts).
+func (m *modules) rewrite(base *url.URL, src string) (string, error) {
+	specs, err := moduleSpecifiers(src)
+	if err != nil {
+		_, err = warn(m.opts, &ParseError{Path: base.String(), Err: err})
+		return src, err
+	}
+
+	var (
+		b    strings.Builder
+		prev int
+	)
+	for _, sp := range specs {
+		u, bare, err := m.imap.resolve(base, sp.spec)
+		if err != nil {
+			err = &ParseError{Path: sp.spec, Err: err}
+		}
+		cont, err := warn(m.opts, err)
+		if err != nil {
+			return "", err
+		}
+		if !cont || u == nil {
+			continue
+		}
+
+		n, err := m.load(u)
+		if err != nil {
+			return "", err
+		}
+		if n == "" || bare {
+			continue
+		}
+		if _, ok := m.urls[n]; ok {
+			m.refs[n] = struct{}{}
+		}
+		b.WriteString(src[prev:sp.start])
+		b.WriteString(strconv.Quote(n))
+		prev = sp.end
+	}
+	b.WriteString(src[prev:])
+	return b.String(), nil
+}
+
+// Load the module at u and all of its dependencies, returning the specifier to
+// use for it.
+//
+// This returns "" if the module isn't inlined and the specifier should be kept
+// as-is.
+func (m *modules) load(u *url.URL) (string, error) {
+	key := u.String()
+	if _, ok := m.urls[key]; ok {
+		return key, nil
+	}
+
+	// Use the absolute URL for remote modules that aren't inlined, as relative
+	// specifiers don't work in data: URLs.
+	skip := ""
+	if isRemoteURL(u) {
+		skip = key
+	}
+	if isRemoteURL(u) && !m.opts.Remote.Has(JS) {
+		return skip, nil
+	}
+	if !isRemoteURL(u) && !m.opts.Local.Has(JS) {
+		return skip, nil
+	}
+
+	res, err := m.opts.fetch(u)
+	cont, err := warn(m.opts, err)
+	if err != nil {
+		return "", err
+	}
+	if !cont {
+		return skip, nil
+	}
+
+	m.urls[key] = "" // Mark as loading for circular imports.
+	src, err := m.rewrite(resourceURL(u, res), string(res.Data))
+	if err != nil {
+		return "", err
+	}
+
+	typ := res.MediaType()
+	data, err := m.opts.process("module", res.URL, src, func() (string, error) {
+		var err error
+		switch {
+		case isJSONType(typ):
+			src, err = processScript(m.opts, typ, src)
+		case typ == "text/css":
+			if m.opts.Minify.Has(CSS) {
+				src, err = minifier.String("css", src)
+			}
+		default:
+			typ = "text/javascript"
+			src, err = processScript(m.opts, "module", src)
+		}
+		if err != nil {
+			return "", fmt.Errorf("could not minify %v: %v", res.URL, err)
+		}
+		return "data:" + typ + ";base64," + base64.StdEncoding.EncodeToString([]byte(src)), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	m.urls[key] = data
+	return key, nil
+}
+
+// Add the inlined modules to the document's import map, creating a new import
+// map before the first module script if there isn't one yet.
+//
+// All modules in the import map are inlined, even if they're not imported
+// statically, as they may be used with a dynamic import().
+func (m *modules) writeImportMap(doc *goquery.Document) error {
+	for _, addr := range m.imap.modules() {
+		u, err := url.Parse(addr)
+		if err != nil {
+			continue
+		}
+		if _, err := m.load(u); err != nil {
+			return err
+		}
+	}
+
+	imports, _ := m.imap.raw["imports"].(map[string]any)
+	if imports == nil {
+		imports = make(map[string]any)
+	}
+	changed := false
+	for k, v := range imports {
+		if _, ok := v.(string); !ok {
+			continue
+		}
+		addr := m.imap.imports[normalizeSpecifier(m.imap.base, k)]
+		if d := m.urls[addr]; d != "" {
+			imports[k], changed = d, true
+		}
+	}
+	for k := range m.refs {
+		if _, ok := imports[k]; !ok && m.urls[k] != "" {
+			imports[k], changed = m.urls[k], true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	m.imap.raw["imports"] = imports
+
+	j, err := json.Marshal(m.imap.raw)
+	if err != nil {
+		return err
+	}
+	if m.imap.s != nil {
+		m.imap.s.SetHtml(escapeScript("importmap", string(j)))
+		return nil
+	}
+	doc.Find(`script`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if scriptType(s) == "module" {
+			s.BeforeHtml(`<script type="importmap">` + escapeScript("importmap", string(j)) + `</script>`)
+			return false
+		}
+		return true
+	})
+	return nil
+}
+
+// Report if a module specifier is a URL or path, rather than a bare specifier
+// such as "lodash".
+//
+// https://html.spec.whatwg.org/multipage/webappapis.html#resolve-a-module-specifier
+func isURLSpecifier(spec string) bool {
+	if strings.HasPrefix(spec, "/") || strings.HasPrefix(spec, "./") || strings.HasPrefix(spec, "../") {
+		return true
+	}
+	u, err := url.Parse(spec)
+	return err == nil && u.Scheme != ""
+}
+
+// moduleSpecifier is a module specifier in a script.
+type moduleSpecifier struct {
+	spec       string // Unquoted specifier.
+	start, end int    // Position of the string literal, including quotes.
+}
+
+type jsToken struct {
+	tt   js.TokenType
+	text string
+	pos  int
+}
+
+// moduleSpecifiers finds all static import and export specifiers in a module,
+// as well as dynamic imports with a string literal:
+//
+//	import "a.js"
+//	import x, {y} from "a.js"
+//	export * as x from "a.js"
+//	import("a.js")
+//
+// This doesn't parse the full JavaScript, and whether a "/" is a division or a
+// regular expression is guessed from the previous token.
+func moduleSpecifiers(src string) ([]moduleSpecifier, error) {
+	var (
+		l    = js.NewLexer(parse.NewInputString(src))
+		toks []jsToken
+		pos  int
+	)
+	for {
+		tt, text := l.Next()
+		switch tt {
+		case js.ErrorToken:
+			if l.Err() != io.EOF {
+				return nil, l.Err()
+			}
+			return findSpecifiers(toks), nil
+		case js.WhitespaceToken, js.LineTerminatorToken, js.CommentToken, js.CommentLineTerminatorToken:
+			pos += len(text)
+			continue
+		case js.DivToken, js.DivEqToken:
+			if len(toks) == 0 || !endsExpression(toks[len(toks)-1].tt) {
+				tt, text = l.RegExp()
+				if tt == js.ErrorToken {
+					return nil, l.Err()
+				}
+			}
+		}
+		toks = append(toks, jsToken{tt, string(text), pos})
+		pos += len(text)
+	}
+}
+
+// Report if a token can be at the end of an expression, in which case a "/"
+// after it is a division rather than the start of a regular expression.
+func endsExpression(tt js.TokenType) bool {
+	switch tt {
+	case js.CloseParenToken, js.CloseBracketToken, js.CloseBraceToken,
+		js.StringToken, js.TemplateToken, js.TemplateEndToken, js.RegExpToken,
+		js.ThisToken, js.SuperToken, js.NullToken, js.TrueToken, js.FalseToken,
+		js.IncrToken, js.DecrToken, js.PrivateIdentifierToken:
+		return true
+	}
+	return js.IsNumeric(tt) || js.IsIdentifier(tt)
+}
+
+func findSpecifiers(toks []jsToken) []moduleSpecifier {
+	var specs []moduleSpecifier
+	add := func(t jsToken) {
+		s, ok := unquoteJS(t.text)
+		if ok {
+			specs = append(specs, moduleSpecifier{spec: s, start: t.pos, end: t.pos + len(t.text)})
+		}
+	}
+	// Find the string after the "from" in a import or export clause.
+	from := func(i int) int {
+		for ; i < len(toks); i++ {
+			switch toks[i].tt {
+			case js.SemicolonToken:
+				return i
+			case js.FromToken:
+				if i+1 < len(toks) && toks[i+1].tt == js.StringToken {
+					add(toks[i+1])
+					return i + 1
+				}
+			}
+		}
+		return i
+	}
+
+	for i := 0; i < len(toks); i++ {
+		// import.meta, x.import, etc.
+		if i > 0 && (toks[i-1].tt == js.DotToken || toks[i-1].tt == js.OptChainToken) {
+			continue
+		}
+		if i+1 >= len(toks) {
+			break
+		}
+		next := toks[i+1]
+
+		switch toks[i].tt {
+		case js.ImportToken:
+			switch next.tt {
+			case js.DotToken:
+			case js.OpenParenToken: // import("a.js")
+				if i+2 < len(toks) && toks[i+2].tt == js.StringToken {
+					add(toks[i+2])
+				}
+			case js.StringToken: // import "a.js"
+				add(next)
+				i++
+			default: // import x from "a.js"
+				i = from(i + 1)
+			}
+		case js.ExportToken:
+			switch next.tt {
+			case js.MulToken: // export * from "a.js"
+				i = from(i + 1)
+			case js.OpenBraceToken: // export {x} from "a.js"
+				j := i + 1
+				for j < len(toks) && toks[j].tt != js.CloseBraceToken {
+					j++
+				}
+				if j+1 < len(toks) && toks[j+1].tt == js.FromToken {
+					j = from(j + 1)
+				}
+				i = j
+			}
+		}
+	}
+	return specs
+}
+
+// Unquote a JavaScript string literal; this returns false for strings with
+// escape sequences, which are never used in practice for module specifiers.
+func unquoteJS(s string) (string, bool) {
+	if len(s) < 2 || strings.Contains(s, `\`) {
+		return "", false
+	}
+	return s[1 : len(s)-1], true
+}
@@ -0,0 +1,145 @@
+package singlepage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestModuleSpecifiers(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`import "./a.js"`, []string{"./a.js"}},
+		{`import './a.js';`, []string{"./a.js"}},
+		{`import x from "./a.js"`, []string{"./a.js"}},
+		{`import x, {y as z} from "./a.js"`, []string{"./a.js"}},
+		{`import {"a-b" as ab} from "./a.js"`, []string{"./a.js"}},
+		{`import * as x from "./a.js"; import "./b.js"`, []string{"./a.js", "./b.js"}},
+		{`import data from "./a.json" with {type: "json"}`, []string{"./a.json"}},
+		{`export * from "./a.js"`, []string{"./a.js"}},
+		{`export * as x from "./a.js"`, []string{"./a.js"}},
+		{`export {x, y as z} from "./a.js"`, []string{"./a.js"}},
+		{"export {x}\nimport './a.js'", []string{"./a.js"}},
+		{`export const x = 1; export default "./a.js"`, nil},
+		{`const m = await import("./a.js")`, []string{"./a.js"}},
+		{`import(x)`, nil},
+		{`console.log(import.meta.url)`, nil},
+		{`x.import("./a.js")`, nil},
+		{`// import "./a.js"` + "\n/* import './b.js' */", nil},
+		{`let s = "import './a.js'"`, nil},
+		{"let s = `import './a.js'`", nil},
+		{`let r = /import "a"/; import "./a.js"`, []string{"./a.js"}},
+		{`let r = a / 2 / 1; import "./a.js"`, []string{"./a.js"}},
+		{"import \"./a.js\"\nimport `./b.js`", []string{"./a.js"}},
+		{`import "./\u0061.js"`, nil},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			specs, err := moduleSpecifiers(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out []string
+			for _, s := range specs {
+				out = append(out, s.spec)
+				if q := tt.in[s.start:s.end]; q[1:len(q)-1] != s.spec {
+					t.Errorf("wrong position: %q", q)
+				}
+			}
+			if !reflect.DeepEqual(out, tt.want) {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsURLSpecifier(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"./a.js", true},
+		{"../a.js", true},
+		{"/a.js", true},
+		{"https://example.com/a.js", true},
+		{"a.js", false},
+		{"lodash", false},
+		{"@scope/pkg", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out := isURLSpecifier(tt.in)
+			if out != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestModules(t *testing.T) {
+	util := `import d from "file:///js/data.json" with {type: "json"}; export * from "file:///js/lib/cycle.js"; export const f = () => d`
+	importMap := `<script type="importmap">{"imports":{` +
+		`"file:///js/data.json":"data:application/json;base64,eyJhIjogMX0=",` +
+		`"file:///js/lib/cycle.js":"data:text/javascript;base64,` +
+		base64.StdEncoding.EncodeToString([]byte(`import "file:///js/lib/util.js"; export const c = 1`)) + `",` +
+		`"file:///js/lib/util.js":"data:text/javascript;base64,` + base64.StdEncoding.EncodeToString([]byte(util)) + `"}}</script>`
+
+	tests := []struct {
+		in, want string
+		opts     Options
+	}{
+		{
+			`<script type="module" src="js/app.js"></script>`,
+			importMap + `<script type="module">import {f} from "file:///js/lib/util.js"; import "lodash"; f()</script>`,
+			Options{Root: "./testdata/module", Local: JS},
+		},
+		{
+			`<script type="module">import {f} from "./js/lib/util.js"</script>`,
+			importMap + `<script type="module">import {f} from "file:///js/lib/util.js"</script>`,
+			Options{Root: "./testdata/module", Local: JS},
+		},
+		{ // Merge with existing import map.
+			`<script type="importmap">{"imports": {"lodash": "/lodash.js"}, "scopes": {}}</script>` +
+				`<script type="module">import "./js/data.json" with {type: "json"}</script>`,
+			`<script type="importmap">{"imports":{"file:///js/data.json":"data:application/json;base64,eyJhIjogMX0=",` +
+				`"lodash":"/lodash.js"},"scopes":{}}</script>` +
+				`<script type="module">import "file:///js/data.json" with {type: "json"}</script>`,
+			Options{Root: "./testdata/module", Local: JS, Quiet: true},
+		},
+		{ // Not found
+			`<script type="module">import "./nonexistent.js"</script>`,
+			`<script type="module">import "./nonexistent.js"</script>`,
+			Options{Root: "./testdata/module", Local: JS, Quiet: true},
+		},
+		{ // Remote not enabled: use absolute URL.
+			`<script type="module">import "./a.js"</script>`,
+			`<script type="module">import "https://example.com/a.js"</script>`,
+			Options{Root: "https://example.com", Local: JS},
+		},
+		{ // Classic scripts are left alone.
+			`<script>import("./js/data.json")</script>`,
+			`<script>import("./js/data.json")</script>`,
+			Options{Root: "./testdata/module", Local: JS},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.in = `<html><head></head><body>` + tt.in + `</body></html>`
+			tt.want = `<html><head></head><body>` + tt.want + `</body></html>`
+
+			o, err := Bundle([]byte(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+}
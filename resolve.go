@@ -0,0 +1,149 @@
+package singlepage
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// References are resolved with the same rules a browser uses, with one
+// exception: local paths are resolved as if the Root directory is served over
+// HTTP. A root-relative reference such as "/x.css" refers to x.css in the Root
+// directory, and "../" can never go above Root.
+//
+// Internally, local locations are represented as "file:///path", where "/" is
+// the Root directory.
+
+// rootURL gets the URL for Options.Root.
+func (opts Options) rootURL() (*url.URL, error) {
+	if !isRemote(opts.Root) {
+		return &url.URL{Scheme: "file", Path: "/"}, nil
+	}
+
+	root := opts.Root
+	if strings.HasPrefix(root, "//") {
+		root = "https:" + root
+	}
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Root %q: %w", opts.Root, err)
+	}
+	// Root is always a directory; "http://example.com/docs" should resolve
+	// "x.css" to "http://example.com/docs/x.css".
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath, u.RawQuery, u.Fragment = "", "", ""
+	return u, nil
+}
+
+// documentBase gets the base URL for the document, which is Root (or the
+// location of the document for frames) combined with the first <base href="..">
+// element, if any.
+func documentBase(doc *goquery.Document, opts Options) (*url.URL, error) {
+	root, err := opts.baseURL()
+	if err != nil {
+		return nil, err
+	}
+
+	href, ok := doc.Find(`base[href]`).First().Attr("href")
+	if !ok {
+		return root, nil
+	}
+	u, err := resolve(root, href)
+	_, err = warn(opts, err)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return root, nil
+	}
+	return u, nil
+}
+
+// baseURL gets the URL that references in the document are resolved against.
+func (opts Options) baseURL() (*url.URL, error) {
+	if opts.base != nil {
+		return opts.base, nil
+	}
+	return opts.rootURL()
+}
+
+// resolve a reference against base.
+//
+// This returns nil without an error if the reference is something we can't
+// fetch, such as data: URLs, fragments, or "mailto:" links.
+func resolve(base *url.URL, ref string) (*url.URL, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || ref[0] == '#' {
+		return nil, nil
+	}
+
+	r, err := url.Parse(ref)
+	if err != nil {
+		return nil, &ParseError{Path: ref, Err: err}
+	}
+	// Protocol-relative URLs in local documents; there's no protocol to be
+	// relative to, so use https.
+	if r.Scheme == "" && r.Host != "" && base.Scheme == "file" {
+		r.Scheme = "https"
+	}
+
+	u := base.ResolveReference(r)
+	switch u.Scheme {
+	case "http", "https", "file":
+		return u, nil
+	default:
+		return nil, nil
+	}
+}
+
+// isRemoteURL reports if a resolved URL is remote.
+func isRemoteURL(u *url.URL) bool { return u.Scheme != "file" }
+
+// Get the origin of a resolved URL, for comparing; all local files have the
+// same origin.
+func origin(u *url.URL) string {
+	if !isRemoteURL(u) {
+		return "file:"
+	}
+	scheme, port := strings.ToLower(u.Scheme), u.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	return scheme + "://" + strings.ToLower(u.Hostname()) + ":" + port
+}
+
+// fetchPath gets the path to pass to the Fetcher for a resolved URL.
+//
+// Fragments are never included, and the query string is only included for
+// remote paths.
+func (opts Options) fetchPath(u *url.URL) string {
+	if isRemoteURL(u) {
+		cp := *u
+		cp.Fragment, cp.RawFragment = "", ""
+		return cp.String()
+	}
+
+	root := opts.Root
+	if root == "" {
+		root = "."
+	}
+	return filepath.Join(root, filepath.FromSlash(u.Path))
+}
+
+// resourceURL gets the URL of a fetched resource, which is the final URL after
+// any redirects for remote resources.
+func resourceURL(u *url.URL, res *Resource) *url.URL {
+	if !isRemoteURL(u) || res == nil || !isRemote(res.URL) {
+		return u
+	}
+	final, err := url.Parse(res.URL)
+	if err != nil {
+		return u
+	}
+	return final
+}
@@ -0,0 +1,103 @@
+package singlepage
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		root, ref, want string
+	}{
+		{"", "a.css", "a.css"},
+		{"", "./a.css", "a.css"},
+		{"", "/a.css", "a.css"},
+		{"", "../../a.css", "a.css"},
+		{"", "x/../y/./a.css", "y/a.css"},
+		{"", "a.css?v=1#frag", "a.css"},
+		{"", "//cdn.example.com/a.css", "https://cdn.example.com/a.css"},
+		{"", "https://cdn.example.com/a.css?v=1#frag", "https://cdn.example.com/a.css?v=1"},
+		{"", "http://cdn.example.com/../a.css", "http://cdn.example.com/a.css"},
+		{"", "  a.css ", "a.css"},
+
+		{"./", "a.css", "a.css"},
+		{"site", "a.css", "site/a.css"},
+		{"site/", "./x/a.css", "site/x/a.css"},
+		{"site/", "/a.css", "site/a.css"},
+		{"site/", "../a.css", "site/a.css"},
+		{"/srv/site", "/a.css", "/srv/site/a.css"},
+		{"site", "https://cdn.example.com/a.css", "https://cdn.example.com/a.css"},
+
+		{"http://example.com", "a.css", "http://example.com/a.css"},
+		{"http://example.com/docs", "a.css", "http://example.com/docs/a.css"},
+		{"http://example.com/docs/", "../a.css", "http://example.com/a.css"},
+		{"http://example.com/docs/", "/a.css", "http://example.com/a.css"},
+		{"http://example.com/docs/", "//cdn.example.com/a.css", "http://cdn.example.com/a.css"},
+		{"//example.com/docs", "a.css", "https://example.com/docs/a.css"},
+		{"https://example.com", "a.css?x=y", "https://example.com/a.css?x=y"},
+
+		{"", "", ""},
+		{"", "#frag", ""},
+		{"", "data:image/png;base64,iVBORw0KGgoAAA==", ""},
+		{"", "mailto:me@example.com", ""},
+		{"", "javascript:void(0)", ""},
+		{"http://example.com", "about:blank", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.root+" "+tt.ref, func(t *testing.T) {
+			opts := Options{Root: tt.root}
+			base, err := opts.rootURL()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, err := resolve(base, tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out string
+			if u != nil {
+				out = opts.fetchPath(u)
+			}
+			if out != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveError(t *testing.T) {
+	base, _ := Options{}.rootURL()
+	_, err := resolve(base, "http://[::1")
+	if _, ok := err.(*ParseError); !ok {
+		t.Errorf("wrong error: %#v", err)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"file:///a.html", "file:///x/b.html", true},
+		{"https://example.com/a.html", "HTTPS://EXAMPLE.com:443/b", true},
+		{"http://example.com:80/", "http://example.com/", true},
+		{"http://example.com/", "https://example.com/", false},
+		{"https://example.com/", "https://example.com:8080/", false},
+		{"https://example.com/", "https://sub.example.com/", false},
+		{"https://example.com/", "file:///a.html", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, _ := url.Parse(tt.a)
+			b, _ := url.Parse(tt.b)
+			out := origin(a) == origin(b)
+			if out != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
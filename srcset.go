@@ -0,0 +1,162 @@
+package singlepage
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SrcsetMode controls how srcset attributes on <img> and <picture><source>
+// are inlined.
+type SrcsetMode uint8
+
+// SrcsetMode values.
+const (
+	// Inline every candidate in the srcset.
+	SrcsetAll SrcsetMode = iota
+
+	// Inline only the candidate with the largest width or pixel density,
+	// removing all others.
+	SrcsetLargest
+
+	// Inline only the candidate with the descriptor in
+	// Options.SrcsetDescriptor (e.g. "2x" or "800w"), removing all others.
+	// The largest candidate is used if there is no such candidate.
+	SrcsetMatch
+
+	// Remove the srcset and sizes attributes and <picture><source> elements,
+	// leaving just the src. If an <img> has no src then the largest
+	// candidate is used as the src.
+	SrcsetSrc
+)
+
+// srcsetCandidate is an image candidate in a srcset attribute.
+type srcsetCandidate struct {
+	url  string
+	desc string // Descriptor, e.g. "2x" or "800w"; may be blank.
+}
+
+// parseSrcset parses a srcset attribute.
+//
+// https://html.spec.whatwg.org/multipage/images.html#parse-a-srcset-attribute
+func parseSrcset(s string) []srcsetCandidate {
+	var (
+		cands []srcsetCandidate
+		isWS  = func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+	)
+	for i := 0; i < len(s); {
+		// Skip whitespace and commas.
+		for i < len(s) && (isWS(s[i]) || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+
+		// URL runs until whitespace; trailing commas end the candidate
+		// without descriptors. This allows commas in URLs, such as in data:
+		// URLs.
+		start := i
+		for i < len(s) && !isWS(s[i]) {
+			i++
+		}
+		u := s[start:i]
+		if strings.HasSuffix(u, ",") {
+			cands = append(cands, srcsetCandidate{url: strings.TrimRight(u, ",")})
+			continue
+		}
+
+		// Descriptors run until a comma that's not in parenthesis.
+		start, paren := i, false
+		for ; i < len(s); i++ {
+			if s[i] == '(' {
+				paren = true
+			} else if s[i] == ')' {
+				paren = false
+			} else if s[i] == ',' && !paren {
+				break
+			}
+		}
+		cands = append(cands, srcsetCandidate{url: u, desc: strings.Join(strings.Fields(s[start:i]), " ")})
+		if i < len(s) {
+			i++
+		}
+	}
+	return cands
+}
+
+// formatSrcset formats a list of candidates as a srcset attribute.
+func formatSrcset(cands []srcsetCandidate) string {
+	var b strings.Builder
+	for i, c := range cands {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(c.url)
+		if c.desc != "" {
+			b.WriteString(" " + c.desc)
+		}
+	}
+	return b.String()
+}
+
+// Get the width and density of a candidate; candidates without a descriptor
+// are "1x".
+func (c srcsetCandidate) size() (w, x float64) {
+	x = 1
+	for _, d := range strings.Fields(c.desc) {
+		n, err := strconv.ParseFloat(d[:len(d)-1], 64)
+		if err != nil {
+			continue
+		}
+		switch d[len(d)-1] {
+		case 'w':
+			w = n
+		case 'x':
+			x = n
+		}
+	}
+	return w, x
+}
+
+// Get the candidate with the largest width, or the largest density if there
+// are no widths.
+func largestCandidate(cands []srcsetCandidate) srcsetCandidate {
+	var (
+		largest      srcsetCandidate
+		maxW, maxX   float64
+		haveW, first = false, true
+	)
+	for _, c := range cands {
+		w, x := c.size()
+		switch {
+		case w > 0 && (!haveW || w > maxW):
+			largest, maxW, haveW = c, w, true
+		case !haveW && (first || x > maxX):
+			largest, maxX = c, x
+		}
+		first = false
+	}
+	return largest
+}
+
+// Select the candidates to inline according to the mode.
+func selectSrcset(cands []srcsetCandidate, mode SrcsetMode, desc string) []srcsetCandidate {
+	if len(cands) == 0 {
+		return cands
+	}
+	switch mode {
+	case SrcsetLargest:
+		return []srcsetCandidate{largestCandidate(cands)}
+	case SrcsetMatch:
+		desc = strings.ToLower(strings.TrimSpace(desc))
+		for _, c := range cands {
+			d := strings.ToLower(c.desc)
+			if d == desc || (d == "" && desc == "1x") {
+				return []srcsetCandidate{c}
+			}
+		}
+		return []srcsetCandidate{largestCandidate(cands)}
+	default:
+		return cands
+	}
+}
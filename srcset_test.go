@@ -0,0 +1,59 @@
+package singlepage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSrcset(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []srcsetCandidate
+	}{
+		{"", nil},
+		{"a.png", []srcsetCandidate{{"a.png", ""}}},
+		{"a.png 1x, b.png 2x", []srcsetCandidate{{"a.png", "1x"}, {"b.png", "2x"}}},
+		{"  a.png  100w ,b.png   200w  ", []srcsetCandidate{{"a.png", "100w"}, {"b.png", "200w"}}},
+		{"a.png, b.png 2x", []srcsetCandidate{{"a.png", ""}, {"b.png", "2x"}}},
+		{"a,b.png 2x", []srcsetCandidate{{"a,b.png", "2x"}}},
+		{"data:image/png;base64,AAA= 2x, b.png", []srcsetCandidate{{"data:image/png;base64,AAA=", "2x"}, {"b.png", ""}}},
+		{"a.png 100w 50h, b.png", []srcsetCandidate{{"a.png", "100w 50h"}, {"b.png", ""}}},
+		{"a.png (x, y), b.png", []srcsetCandidate{{"a.png", "(x, y)"}, {"b.png", ""}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out := parseSrcset(tt.in)
+			if !reflect.DeepEqual(out, tt.want) {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectSrcset(t *testing.T) {
+	tests := []struct {
+		in   string
+		mode SrcsetMode
+		desc string
+		want string
+	}{
+		{"a.png 1x, b.png 2x", SrcsetAll, "", "a.png 1x, b.png 2x"},
+		{"a.png 1x, b.png 2x", SrcsetLargest, "", "b.png 2x"},
+		{"a.png, b.png 1.5x", SrcsetLargest, "", "b.png 1.5x"},
+		{"a.png 300w, b.png 900w, c.png 600w", SrcsetLargest, "", "b.png 900w"},
+		{"a.png 1x, b.png 2x", SrcsetMatch, "1x", "a.png 1x"},
+		{"a.png, b.png 2x", SrcsetMatch, "1x", "a.png"},
+		{"a.png 300w, b.png 900w", SrcsetMatch, "300W", "a.png 300w"},
+		{"a.png 300w, b.png 900w", SrcsetMatch, "2x", "b.png 900w"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out := formatSrcset(selectSrcset(parseSrcset(tt.in), tt.mode, tt.desc))
+			if out != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,498 @@
+package singlepage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/xml"
+	xhtml "golang.org/x/net/html"
+)
+
+// SVGMode controls how SVG images are inlined.
+type SVGMode uint8
+
+// SVGMode values.
+const (
+	// Use a base64-encoded data: URI, like all other images.
+	SVGBase64 SVGMode = iota
+
+	// Use a percent-encoded UTF-8 data: URI, which is usually quite a bit
+	// smaller than base64.
+	SVGDataURI
+
+	// Replace <img> elements with the <svg> markup; the id, class, style,
+	// width, height, and data-* attributes are copied to the <svg>, alt is
+	// used as the aria-label, and title is added as a <title> element. This is
+	// only done for <img> elements without srcset that aren't in a <picture>,
+	// and for SVGs without active content (scripts, event handlers,
+	// javascript: links) or <style> elements, which would apply to the entire
+	// document; a UTF-8 data: URI is used for everything else.
+	//
+	// Note that unlike SVGs loaded with <img>, inline SVGs are styled by the
+	// document's CSS and share the document's ids.
+	SVGInline
+)
+
+const svgType = "image/svg+xml"
+
+// Process the SVG in res: inline nested references and minify it if Minify has
+// Image.
+func processSVG(opts Options, u *url.URL, res *Resource) (string, error) {
+	s, err := replaceSVGURLs(opts, resourceURL(u, res), string(res.Data))
+	if err != nil {
+		return "", fmt.Errorf("could not parse %v: %v", res.URL, err)
+	}
+	if !opts.Minify.Has(Image) {
+		return s, nil
+	}
+	s, err = minifier.String(svgType, s)
+	if err != nil {
+		return "", fmt.Errorf("could not minify %v: %v", res.URL, err)
+	}
+	return s, nil
+}
+
+// Maximum depth of SVG images in SVG images.
+const maxSVGDepth = 16
+
+// Inline the references in the SVG s: <image href="..">, and url()s and
+// @imports in <style> elements and style="" attributes.
+//
+// References are resolved relative to base, which should be the location of
+// the SVG. Everything else is left as-is, so the result is still valid XML.
+func replaceSVGURLs(opts Options, base *url.URL, s string) (string, error) {
+	p := opts.fetchPath(base)
+	if slices.Contains(opts.svgChain, p) {
+		_, err := warn(opts, &ParseError{Path: p, Err: fmt.Errorf("circular SVG image: %s",
+			strings.Join(append(opts.svgChain, p), " → "))})
+		return s, err
+	}
+	if len(opts.svgChain) >= maxSVGDepth {
+		_, err := warn(opts, &ParseError{Path: p, Err: fmt.Errorf("SVG images nested more than %d levels deep: %s",
+			maxSVGDepth, strings.Join(append(opts.svgChain, p), " → "))})
+		return s, err
+	}
+	opts.svgChain = append(slices.Clip(opts.svgChain), p)
+
+	var (
+		l     = xml.NewLexer(parse.NewInputString(s))
+		b     strings.Builder
+		tag   string
+		style bool // In a <style> element.
+	)
+	for {
+		tt, text := l.Next()
+		switch tt {
+		case xml.ErrorToken:
+			if l.Err() != io.EOF {
+				return "", l.Err()
+			}
+			return b.String(), nil
+
+		case xml.StartTagToken:
+			tag = string(l.Text())
+			style = tag == "style"
+			b.Write(text)
+		case xml.EndTagToken:
+			style = false
+			b.Write(text)
+
+		case xml.AttributeToken:
+			name, val := string(l.Text()), l.AttrVal()
+			if len(val) < 2 || (val[0] != '"' && val[0] != '\'') {
+				b.Write(text)
+				continue
+			}
+			v := html.UnescapeString(string(val[1 : len(val)-1]))
+
+			var (
+				n   string
+				err error
+			)
+			switch {
+			case (tag == "image" || tag == "feImage") && (name == "href" || name == "xlink:href"):
+				n, err = inlineImg(opts, base, v)
+			case name == "style":
+				n, err = replaceCSSURLs(opts, base, v, newImports(opts, nil))
+				if n == v {
+					n = ""
+				}
+			}
+			if err != nil {
+				return "", err
+			}
+			if n == "" {
+				b.Write(text)
+				continue
+			}
+			// The lexeme includes the whitespace before the attribute.
+			b.Write(text[:len(text)-len(bytes.TrimLeft(text, " \t\r\n"))])
+			b.WriteString(name + `="` + xmlEscaper.Replace(n) + `"`)
+
+		case xml.TextToken, xml.CDATAToken:
+			if !style {
+				b.Write(text)
+				continue
+			}
+			css := html.UnescapeString(string(text))
+			if tt == xml.CDATAToken {
+				css = string(l.Text())
+			}
+			n, err := replaceCSSURLs(opts, base, css, newImports(opts, nil))
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case n == css:
+				b.Write(text)
+			case tt == xml.CDATAToken:
+				b.WriteString("<![CDATA[" + strings.ReplaceAll(n, "]]>", "]]]]><![CDATA[>") + "]]>")
+			default:
+				b.WriteString(xmlTextEscaper.Replace(n))
+			}
+
+		default:
+			b.Write(text)
+		}
+	}
+}
+
+// Get the data: URI for the SVG s, according to the SVG mode.
+func svgDataURI(opts Options, s string) string {
+	if opts.SVG == SVGBase64 {
+		return "data:" + svgType + ";base64," + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	return "data:" + svgType + "," + percentEncode(s)
+}
+
+// Percent-encode s for use in a data: URI.
+//
+// This leaves most characters alone, but encodes characters that aren't valid
+// in URLs, as well as whitespace (so it can be used in srcset), quotes, and
+// non-ASCII.
+func percentEncode(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			strings.IndexByte("-._~!$&'()*+,;=:@/?", c) > -1:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
+
+var (
+	xmlEscaper     = strings.NewReplacer(`&`, "&amp;", `<`, "&lt;", `"`, "&quot;")
+	xmlTextEscaper = strings.NewReplacer(`&`, "&amp;", `<`, "&lt;", `]]>`, "]]&gt;")
+)
+
+// Replace <img src="x.svg"> with the <svg> markup.
+//
+// This returns false if the image wasn't replaced, for example because it's not
+// an SVG.
+func inlineSVG(opts Options, base *url.URL, s *goquery.Selection) (bool, error) {
+	if _, ok := s.Attr("srcset"); ok || s.Parent().Is("picture") {
+		return false, nil
+	}
+	u, err := resolve(base, s.AttrOr("src", ""))
+	if err != nil || u == nil {
+		return false, nil // Reported by inlineImg().
+	}
+	if isRemoteURL(u) && !opts.Remote.Has(Image) {
+		return false, nil
+	}
+	if !isRemoteURL(u) && !opts.Local.Has(Image) {
+		return false, nil
+	}
+
+	res, err := opts.fetch(u)
+	if err != nil {
+		return false, opts.context().Err() // Other errors are reported by inlineImg().
+	}
+	if res.MediaType() != svgType {
+		return false, nil
+	}
+
+	svg, err := opts.process("svg", res.URL, "", func() (string, error) {
+		return processSVG(opts, u, res)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	frag, err := goquery.NewDocumentFromReader(strings.NewReader(svg))
+	if err != nil {
+		return false, nil
+	}
+	el := frag.Find("svg").First()
+	if el.Length() == 0 || hasActiveContent(el) {
+		return false, nil
+	}
+
+	if c, ok := s.Attr("class"); ok {
+		el.SetAttr("class", strings.Join(append(strings.Fields(el.AttrOr("class", "")), strings.Fields(c)...), " "))
+	}
+	if st, ok := s.Attr("style"); ok {
+		if svgSt := strings.TrimRight(strings.TrimSpace(el.AttrOr("style", "")), ";"); svgSt != "" {
+			st = svgSt + "; " + st
+		}
+		el.SetAttr("style", st)
+	}
+	for _, a := range s.Nodes[0].Attr {
+		if a.Namespace == "" && (a.Key == "id" || a.Key == "width" || a.Key == "height" || strings.HasPrefix(a.Key, "data-")) {
+			el.SetAttr(a.Key, a.Val)
+		}
+	}
+	if title, ok := s.Attr("title"); ok {
+		el.Find("title").FilterFunction(func(i int, t *goquery.Selection) bool {
+			return t.Parent().IsSelection(el)
+		}).Remove()
+		el.PrependHtml("<title>" + html.EscapeString(title) + "</title>")
+	}
+	if alt, ok := s.Attr("alt"); ok {
+		if alt == "" {
+			el.SetAttr("aria-hidden", "true")
+		} else {
+			el.SetAttr("role", "img")
+			el.SetAttr("aria-label", alt)
+		}
+	}
+	s.ReplaceWithSelection(el)
+	return true, nil
+}
+
+// Report if the SVG has content that behaves differently in inline SVGs than in
+// SVGs loaded with <img>: scripts, <foreignObject>, event handler attributes,
+// links to javascript: URLs, and animations that set links (which may be set
+// to a javascript: URL), which are all disabled in images. <style> elements
+// are also reported, as they apply to the entire document when inlined.
+func hasActiveContent(s *goquery.Selection) bool {
+	for _, n := range s.Find("*").AddSelection(s).Nodes {
+		switch strings.ToLower(n.Data) {
+		case "script", "foreignobject", "style":
+			return true
+		}
+		for _, a := range n.Attr {
+			k := strings.ToLower(a.Key)
+			switch {
+			case strings.HasPrefix(k, "on"):
+				return true
+			case k == "href" && isJavaScriptURL(a.Val):
+				return true
+			case k == "attributename" && (strings.EqualFold(a.Val, "href") || strings.EqualFold(a.Val, "xlink:href")):
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Report if the URL s uses the javascript: scheme.
+//
+// Browsers strip leading and trailing C0 controls and spaces, and remove tabs
+// and newlines anywhere in the URL.
+func isJavaScriptURL(s string) bool {
+	s = strings.TrimLeftFunc(s, func(r rune) bool { return r <= ' ' })
+	s = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, s)
+	return len(s) >= 11 && strings.EqualFold(s[:11], "javascript:")
+}
+
+// Replace references to external SVG sprites in <use href="sprite.svg#id">
+// with a reference to a local copy of the element: the referenced elements
+// are copied into a hidden <svg> at the start of the <body>, and the href is
+// rewritten to "#id".
+//
+// Elements the referenced elements depend on (e.g. gradients) are copied as
+// well.
+func replaceSVGUse(doc *goquery.Document, opts Options) (err error) {
+	if !opts.Local.Has(Image) && !opts.Remote.Has(Image) {
+		return nil
+	}
+
+	base, err := opts.baseURL()
+	if err != nil {
+		return err
+	}
+
+	var (
+		sprites = make(map[string]*goquery.Document) // Parsed sprites by path.
+		c       = &spriteCopier{opts: opts, doc: doc, ids: make(map[string]string)}
+		cont    bool
+	)
+	doc.Find(`use`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		attr := useHref(s.Nodes[0])
+		if attr == nil {
+			return true
+		}
+		var u *url.URL
+		u, err = resolve(base, attr.Val)
+		cont, err = warn(opts, err)
+		if err != nil {
+			return false
+		}
+		if !cont || u == nil || u.Fragment == "" {
+			return true
+		}
+		if isRemoteURL(u) && !opts.Remote.Has(Image) {
+			return true
+		}
+		if !isRemoteURL(u) && !opts.Local.Has(Image) {
+			return true
+		}
+
+		p := opts.fetchPath(u)
+		sprite, ok := sprites[p]
+		if !ok {
+			var res *Resource
+			res, err = opts.fetch(u)
+			cont, err = warn(opts, err)
+			if err != nil {
+				return false
+			}
+			if !cont {
+				return true
+			}
+			var svg string
+			svg, err = replaceSVGURLs(opts, resourceURL(u, res), string(res.Data))
+			if err != nil {
+				err = fmt.Errorf("could not parse %v: %w", res.URL, err)
+				return false
+			}
+			sprite, err = goquery.NewDocumentFromReader(strings.NewReader(svg))
+			if err != nil {
+				return false
+			}
+			sprites[p] = sprite
+		}
+
+		if findID(sprite.Selection, u.Fragment).Length() == 0 {
+			_, err = warn(opts, &ParseError{Path: p, Err: fmt.Errorf("no element with id %q in %s", u.Fragment, p)})
+			return err == nil
+		}
+		ok, err = c.copy(sprite, p, u.Fragment)
+		if err != nil {
+			return false
+		}
+		if ok {
+			attr.Val = "#" + u.Fragment
+		}
+		return true
+	})
+	if err != nil || len(c.copied) == 0 {
+		return err
+	}
+
+	doc.Find("body").PrependHtml(`<svg xmlns="http://www.w3.org/2000/svg" aria-hidden="true" ` +
+		`style="position:absolute;width:0;height:0;overflow:hidden">` + strings.Join(c.copied, "") + `</svg>`)
+	return nil
+}
+
+// spriteCopier copies elements from SVG sprites.
+type spriteCopier struct {
+	opts   Options
+	doc    *goquery.Document
+	ids    map[string]string // Copied ids → sprite path.
+	copied []string          // HTML of copied elements.
+}
+
+// Copy the element with the given id from the sprite at path, and all elements
+// it refers to.
+//
+// This returns false if the element wasn't copied because the id is already
+// used by something else.
+func (c *spriteCopier) copy(sprite *goquery.Document, path, id string) (bool, error) {
+	if from, ok := c.ids[id]; ok {
+		if from == path {
+			return true, nil
+		}
+		_, err := warn(c.opts, &ParseError{Path: path, Err: fmt.Errorf(
+			"id %q in %s is already used by %s", id, path, from)})
+		return false, err
+	}
+	el := findID(sprite.Selection, id)
+	if el.Length() == 0 { // May refer to an element in the document.
+		return false, nil
+	}
+	if findID(c.doc.Selection, id).Length() > 0 {
+		_, err := warn(c.opts, &ParseError{Path: path, Err: fmt.Errorf(
+			"id %q in %s is already used in the document", id, path)})
+		return false, err
+	}
+
+	h, err := goquery.OuterHtml(el)
+	if err != nil {
+		return false, err
+	}
+	c.ids[id] = path
+	el.Find("[id]").Each(func(i int, s *goquery.Selection) { c.ids[s.AttrOr("id", "")] = path })
+	c.copied = append(c.copied, h)
+	for _, ref := range svgRefs(el) {
+		if _, err := c.copy(sprite, path, ref); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Get the href or xlink:href attribute of a <use> element.
+func useHref(n *xhtml.Node) *xhtml.Attribute {
+	for i := range n.Attr {
+		if n.Attr[i].Key == "href" && (n.Attr[i].Namespace == "" || n.Attr[i].Namespace == "xlink") {
+			return &n.Attr[i]
+		}
+	}
+	return nil
+}
+
+// Find the first element with the given id.
+func findID(s *goquery.Selection, id string) *goquery.Selection {
+	return s.Find("[id]").FilterFunction(func(i int, s *goquery.Selection) bool {
+		return s.AttrOr("id", "") == id
+	}).First()
+}
+
+var reSVGRef = regexp.MustCompile(`url\(\s*['"]?#([^'")\s]+)`)
+
+// Get the ids of all elements that s refers to with href="#id",
+// xlink:href="#id", or url(#id).
+func svgRefs(s *goquery.Selection) []string {
+	var refs []string
+	for _, n := range s.Find("*").AddSelection(s).Nodes {
+		for _, a := range n.Attr {
+			if a.Key == "href" && strings.HasPrefix(a.Val, "#") && len(a.Val) > 1 {
+				refs = append(refs, a.Val[1:])
+			}
+			for _, m := range reSVGRef.FindAllStringSubmatch(a.Val, -1) {
+				refs = append(refs, m[1])
+			}
+		}
+		if n.Data == "style" {
+			for _, m := range reSVGRef.FindAllStringSubmatch(goquery.NewDocumentFromNode(n).Text(), -1) {
+				refs = append(refs, m[1])
+			}
+		}
+	}
+	return refs
+}
@@ -0,0 +1,225 @@
+package singlepage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"zgo.at/zstd/ztest"
+)
+
+func TestPercentEncode(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{`<svg xmlns="http://www.w3.org/2000/svg"/>`, `%3Csvg%20xmlns=%22http://www.w3.org/2000/svg%22/%3E`},
+		{"a\nb #c 100%", "a%0Ab%20%23c%20100%25"},
+		{"ü", "%C3%BC"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out := percentEncode(tt.in)
+			if out != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestSVG(t *testing.T) {
+	icon := `<?xml version="1.0"?>` + "\n" + `<!-- Comment -->` + "\n" +
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10" class="icon">` + "\n" +
+		`  <rect width="10" height="10"/>` + "\n" + `</svg>` + "\n"
+	min := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10" class="icon"><rect width="10" height="10"/></svg>`
+
+	tests := []struct {
+		in, want string
+		opts     Options
+	}{
+		{
+			`<img src="icon.svg"/>`,
+			`<img src="data:image/svg+xml;base64,` + base64.StdEncoding.EncodeToString([]byte(icon)) + `"/>`,
+			Options{Local: Image},
+		},
+		{
+			`<img src="icon.svg"/>`,
+			`<img src="data:image/svg+xml,` + percentEncode(icon) + `"/>`,
+			Options{Local: Image, SVG: SVGDataURI},
+		},
+		{
+			`<img src="icon.svg"/>`,
+			`<img src="data:image/svg+xml,` + percentEncode(min) + `"/>`,
+			Options{Local: Image, Minify: Image, SVG: SVGDataURI},
+		},
+		{
+			`<img src="icon.svg" class="a b" width="20" height="10" alt="An icon" id="x" style="color: red" data-x="y" loading="lazy"/>`,
+			`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10" class="icon a b" style="color: red" width="20" height="10" id="x" data-x="y" role="img" aria-label="An icon">` +
+				"\n" + `  <rect width="10" height="10"></rect>` + "\n" + `</svg>`,
+			Options{Local: Image, SVG: SVGInline},
+		},
+		{
+			`<p><img src="icon.svg" alt=""/></p>`,
+			`<p><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10" class="icon" aria-hidden="true"><rect width="10" height="10"></rect></svg></p>`,
+			Options{Local: Image, Minify: Image, SVG: SVGInline},
+		},
+		{
+			`<img src="icon.svg" title="An <icon>"/>`,
+			`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10" class="icon"><title>An &lt;icon&gt;</title><rect width="10" height="10"></rect></svg>`,
+			Options{Local: Image, Minify: Image, SVG: SVGInline},
+		},
+		{ // srcset, picture, and scripts use a data: URI.
+			`<img src="icon.svg" srcset="icon.svg 2x"/>` +
+				`<picture><img src="icon.svg"/></picture>` +
+				`<img src="script.svg"/><img src="fo.svg"/><img src="onload.svg"/>`,
+			`<img src="data:image/svg+xml,` + percentEncode(min) + `" srcset="data:image/svg+xml,` + percentEncode(min) + ` 2x"/>` +
+				`<picture><img src="data:image/svg+xml,` + percentEncode(min) + `"/></picture>` +
+				`<img src="data:image/svg+xml,` + percentEncode(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`) + `"/>` +
+				`<img src="data:image/svg+xml,` + percentEncode(`<svg xmlns="http://www.w3.org/2000/svg"><foreignObject/></svg>`) + `"/>` +
+				`<img src="data:image/svg+xml,` + percentEncode(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`) + `"/>`,
+			Options{Local: Image, Minify: Image, SVG: SVGInline},
+		},
+		{ // javascript: links and <style> use a data: URI.
+			`<img src="js.svg"/><img src="set.svg"/><img src="style.svg"/>`,
+			`<img src="data:image/svg+xml,` + percentEncode(`<svg xmlns="http://www.w3.org/2000/svg"><a href=" JavaScript:alert(1)"><rect/></a></svg>`) + `"/>` +
+				`<img src="data:image/svg+xml,` + percentEncode(`<svg xmlns="http://www.w3.org/2000/svg"><a><set attributeName="href" to="javascript:alert(1)"/></a></svg>`) + `"/>` +
+				`<img src="data:image/svg+xml,` + percentEncode(`<svg xmlns="http://www.w3.org/2000/svg"><style>body { display: none }</style></svg>`) + `"/>`,
+			Options{Local: Image, SVG: SVGInline},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.in = `<html><head></head><body>` + tt.in + `</body></html>`
+			tt.want = `<html><head></head><body>` + tt.want + `</body></html>`
+			tt.opts.Root = "./testdata/svg"
+
+			o, err := Bundle([]byte(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceSVGUse(t *testing.T) {
+	hidden := `<svg xmlns="http://www.w3.org/2000/svg" aria-hidden="true" style="position:absolute;width:0;height:0;overflow:hidden">`
+	search := `<symbol id="search" viewBox="0 0 10 10"><path d="M0 0" fill="url(#grad)"></path></symbol>` +
+		`<linearGradient id="grad"><stop offset="0"></stop></linearGradient>`
+
+	tests := []struct {
+		in, want string
+		opts     Options
+	}{
+		{
+			`<svg><use href="icons.svg#search"></use></svg><svg><use xlink:href="/icons.svg#search"/></svg>`,
+			hidden + search + `</svg>` +
+				`<svg><use href="#search"></use></svg><svg><use xlink:href="#search"></use></svg>`,
+			Options{Local: Image},
+		},
+		{
+			`<svg><use href="icons.svg#close"></use></svg>`,
+			hidden + `<symbol id="close" viewBox="0 0 10 10"><use xlink:href="#x"></use><g id="x"><path d="M1 1"></path></g></symbol></svg>` +
+				`<svg><use href="#close"></use></svg>`,
+			Options{Local: Image},
+		},
+		{ // Already used.
+			`<p id="dup"></p><svg><use href="icons.svg#search"></use></svg><svg><use href="other.svg#search"></use></svg><svg><use href="icons.svg#dup"></use></svg>`,
+			hidden + search + `</svg>` +
+				`<p id="dup"></p><svg><use href="#search"></use></svg><svg><use href="other.svg#search"></use></svg><svg><use href="icons.svg#dup"></use></svg>`,
+			Options{Local: Image, Quiet: true},
+		},
+		{ // Not found, or not enabled.
+			`<svg><use href="icons.svg#nope"></use></svg><svg><use href="nope.svg#nope"></use></svg><svg><use href="#local"></use></svg>`,
+			`<svg><use href="icons.svg#nope"></use></svg><svg><use href="nope.svg#nope"></use></svg><svg><use href="#local"></use></svg>`,
+			Options{Local: Image, Quiet: true},
+		},
+		{
+			`<svg><use href="icons.svg#search"></use></svg>`,
+			`<svg><use href="icons.svg#search"></use></svg>`,
+			Options{Local: CSS},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			tt.in = `<html><head></head><body>` + tt.in + `</body></html>`
+			tt.want = `<html><head></head><body>` + tt.want + `</body></html>`
+			tt.opts.Root = "./testdata/svg"
+
+			o, err := Bundle([]byte(tt.in), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", o, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceSVGURLs(t *testing.T) {
+	png := `data:image/png;base64,UE5H`
+
+	tests := []struct {
+		in, want string
+	}{
+		{`<svg></svg>`, `<svg></svg>`},
+		{
+			`<?xml version="1.0"?>` + "\n" + `<!DOCTYPE svg>` + "\n" +
+				`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><image width="1" href="p.png"/><image xlink:href='p.png'></image><a href="p.png"/></svg>`,
+			`<?xml version="1.0"?>` + "\n" + `<!DOCTYPE svg>` + "\n" +
+				`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><image width="1" href="` + png + `"/><image xlink:href="` + png + `"></image><a href="p.png"/></svg>`,
+		},
+		{
+			`<svg><style>rect { fill: url(p.png) }</style><rect style='fill: url("p.png")' x="1"/></svg>`,
+			`<svg><style>rect { fill: url(` + png + `) }</style><rect style="fill: url(` + png + `)" x="1"/></svg>`,
+		},
+		{ // Imported CSS is escaped.
+			`<svg><style>@import "n.css"; a::after { content: "&amp;&lt;" }</style></svg>`,
+			`<svg><style>a { &amp;:hover { fill: url(` + png + `) } } /* &lt;b> ]]&gt; */ a::after { content: "&amp;&lt;" }</style></svg>`,
+		},
+		{
+			`<svg><style><![CDATA[@import "s.css"; a > b {}]]></style></svg>`,
+			`<svg><style><![CDATA[rect { fill: url(` + png + `) } a > b {}]]></style></svg>`,
+		},
+		{
+			`<svg><image href="d.svg"/></svg>`,
+			`<svg><image href="data:image/svg+xml;base64,` +
+				base64.StdEncoding.EncodeToString([]byte(`<svg><image href="data:image/svg+xml;base64,`+base64.StdEncoding.EncodeToString([]byte(`<svg><image href="`+png+`"/></svg>`))+`"/></svg>`)) + `"/></svg>`,
+		},
+		{ // Circular; the innermost a.svg is left as-is.
+			`<svg><image href="a.svg"/></svg>`,
+			`<svg><image href="data:image/svg+xml;base64,` +
+				base64.StdEncoding.EncodeToString([]byte(`<svg><image href="data:image/svg+xml;base64,`+base64.StdEncoding.EncodeToString([]byte(`<svg><image href="data:image/svg+xml;base64,`+
+					base64.StdEncoding.EncodeToString([]byte(`<svg><image href="b.svg"/></svg>`))+`"/></svg>`))+`"/></svg>`)) + `"/></svg>`,
+		},
+		{`<svg><image href="xml.svg"/></svg>`, `<svg><image href="data:image/svg+xml;base64,` + base64.StdEncoding.EncodeToString([]byte(`<svg><image href='a&amp;b.png'/></svg>`)) + `"/></svg>`},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			opts := Options{Root: "./testdata/svg", Local: Image | CSS, Quiet: true}
+			out, err := replaceSVGURLs(opts, &url.URL{Scheme: "file", Path: "/img/x.svg"}, tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tt.want {
+				t.Errorf("\nout:  %#v\nwant: %#v\n", out, tt.want)
+			}
+		})
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		opts := Options{Root: "./testdata/svg", Local: Image, Strict: true}
+		_, err := replaceSVGURLs(opts, &url.URL{Scheme: "file", Path: "/img/x.svg"}, `<svg><image href="a.svg"/></svg>`)
+		if !ztest.ErrorContains(err, "circular SVG image: testdata/svg/img/x.svg → testdata/svg/img/a.svg → testdata/svg/img/b.svg → testdata/svg/img/a.svg") {
+			t.Fatal(err)
+		}
+	})
+}
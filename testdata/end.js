@@ -0,0 +1,2 @@
+var s = "</script><b>x</b>";
+// <!-- <script>
@@ -0,0 +1 @@
+import "lit"; import "lit/dir.js"
\ No newline at end of file
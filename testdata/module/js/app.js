@@ -0,0 +1 @@
+import {f} from "./lib/util.js"; import "lodash"; f()
\ No newline at end of file
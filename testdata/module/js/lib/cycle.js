@@ -0,0 +1 @@
+import "./util.js"; export const c = 1
\ No newline at end of file
@@ -0,0 +1 @@
+import d from "../data.json" with {type: "json"}; export * from "./cycle.js"; export const f = () => d
\ No newline at end of file